@@ -0,0 +1,105 @@
+// Copyright (c) 2019, Arm Ltd
+
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/golang/glog"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const sysfsVariablePrefix = "sysfs:"
+
+// allocationSettings are added to every container a device is allocated to
+type allocationSettings struct {
+	envs        map[string]string
+	annotations map[string]string
+	mounts      []DeviceMount
+}
+
+// allocationVariables returns the variables available to the env and
+// annotation templates of an allocation:
+//
+//	RESOURCE_NAME   the name of the resource
+//	DEVICE_IDS      the IDs of the allocated devices
+//	DEVICE_PATH     the host paths of the allocated device files
+//	CONTAINER_PATH  the container paths of the allocated device files
+//	DEVICE          the device paths relative to /dev
+//	1, 2, name...   the capture groups of the matches
+//
+// and sysfs:<attribute> that reads a sysfs attribute of the devices.
+// When several device files are allocated their values are comma-separated,
+// with one entry per device file, empty for the ones without the variable.
+func allocationVariables(resourceName string, ids []string, nodes []deviceNode) func(string) string {
+	vars := map[string]string{
+		"RESOURCE_NAME": resourceName,
+		"DEVICE_IDS":    strings.Join(ids, ","),
+	}
+
+	var hostPaths, containerPaths []string
+	nodeVars := make(map[string][]string)
+	for i, node := range nodes {
+		hostPaths = append(hostPaths, node.hostPath)
+		containerPaths = append(containerPaths, node.containerPath)
+		for name, value := range node.vars {
+			if nodeVars[name] == nil {
+				nodeVars[name] = make([]string, len(nodes))
+			}
+			nodeVars[name][i] = value
+		}
+	}
+	for name, values := range nodeVars {
+		vars[name] = strings.Join(values, ",")
+	}
+	vars["DEVICE_PATH"] = strings.Join(hostPaths, ",")
+	vars["CONTAINER_PATH"] = strings.Join(containerPaths, ",")
+
+	return func(name string) string {
+		if !strings.HasPrefix(name, sysfsVariablePrefix) {
+			return vars[name]
+		}
+
+		attribute := strings.TrimPrefix(name, sysfsVariablePrefix)
+		var values []string
+		for _, node := range nodes {
+			value, err := sysfsAttribute(localPath(node.hostPath), attribute)
+			if err != nil {
+				glog.V(1).Infof("Could not read %s: %s", name, err)
+			}
+			values = append(values, value)
+		}
+		return strings.Join(values, ",")
+	}
+}
+
+// expandSettings expands the templates of the given settings
+func expandSettings(settings map[string]string, vars func(string) string) map[string]string {
+	if len(settings) == 0 {
+		return nil
+	}
+
+	expanded := make(map[string]string)
+	for name, template := range settings {
+		expanded[name] = os.Expand(template, vars)
+	}
+	return expanded
+}
+
+// apiMounts returns the mounts of the settings as sent to kubelet
+func (s allocationSettings) apiMounts() []*pluginapi.Mount {
+	var mounts []*pluginapi.Mount
+	for _, mount := range s.mounts {
+		containerPath := mount.ContainerPath
+		if containerPath == "" {
+			containerPath = mount.HostPath
+		}
+		mounts = append(mounts, &pluginapi.Mount{
+			ContainerPath: containerPath,
+			HostPath:      mount.HostPath,
+			ReadOnly:      mount.ReadOnly,
+		})
+	}
+	return mounts
+}
@@ -9,9 +9,9 @@ import (
 
 func getDevices(n uint) []*pluginapi.Device {
 	var devs []*pluginapi.Device
-	for i := 0; i < n; i++ {
+	for i := uint(0); i < n; i++ {
 		devs = append(devs, &pluginapi.Device{
-			ID:     strconv.Itoa(i),
+			ID:     strconv.FormatUint(uint64(i), 10),
 			Health: pluginapi.Healthy,
 		})
 	}
@@ -27,3 +27,15 @@ func deviceExists(devs []*pluginapi.Device, id string) bool {
 	}
 	return false
 }
+
+func copyDevices(devs []*pluginapi.Device) []*pluginapi.Device {
+	var copied []*pluginapi.Device
+	for _, d := range devs {
+		copied = append(copied, &pluginapi.Device{
+			ID:       d.ID,
+			Health:   d.Health,
+			Topology: d.Topology,
+		})
+	}
+	return copied
+}
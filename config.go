@@ -0,0 +1,515 @@
+// Copyright (c) 2019, Arm Ltd
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/golang/glog"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	configAPIVersion = "smarter-device-manager/v1"
+	configKind       = "DeviceManagerConfig"
+)
+
+var domainRegexp = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+
+type DesiredDevice struct {
+	DeviceMatch   string       `yaml:",omitempty"`
+	NumMaxDevices uint         `yaml:",omitempty"`
+	HealthCheck   *HealthCheck `yaml:",omitempty"`
+
+	// Name of the resource advertised for the rule, required for pools and
+	// composites. For other rules it is a template expanded for every
+	// device matched, it can refer to the capture groups of the pattern
+	// as $1, ${1} or ${name}. Defaults to the device path relative to /dev.
+	Name string `yaml:",omitempty"`
+	// Domain of the resource name, defaults to the -resource-domain flag
+	Domain string `yaml:",omitempty"`
+	// Pool advertises a single resource whose devices are the device
+	// files matched, instead of one resource per device file
+	Pool bool `yaml:",omitempty"`
+	// Composite lists patterns whose matches are all granted together by
+	// a single resource, used instead of DeviceMatch
+	Composite []string `yaml:",omitempty"`
+	// ContainerPath is the path of the device in the container, it can
+	// refer to the capture groups of the pattern as $1, ${1} or ${name}
+	// and to the device path relative to /dev as $DEVICE
+	ContainerPath string `yaml:",omitempty"`
+	// Permissions granted on the devices in the container cgroup, a
+	// combination of r (read), w (write) and m (mknod), "rw" by default
+	Permissions string `yaml:",omitempty"`
+	// Env and Annotations are added to the containers the devices are
+	// allocated to. Their values are templates, see allocationVariables.
+	Env         map[string]string `yaml:",omitempty"`
+	Annotations map[string]string `yaml:",omitempty"`
+	// Mounts are bind mounted in the containers the devices are allocated to
+	Mounts []DeviceMount `yaml:",omitempty"`
+	// Exclude lists patterns of device files the rule does not match even
+	// though DeviceMatch or Composite does
+	Exclude []string `yaml:",omitempty"`
+	// Priority orders the rules when several of them provide the same
+	// resource: the rule with the highest priority is used and the others
+	// are ignored for that resource. Equal priorities keep the
+	// configuration order.
+	Priority int `yaml:",omitempty"`
+	// Type restricts the rule to char or block devices
+	Type string `yaml:",omitempty"`
+	// Major and Minor restrict the rule to the devices whose numbers are in
+	// the ranges, e.g. "189" or "4,188-189". Along with Type they can be
+	// used instead of DeviceMatch to match any device file.
+	Major string `yaml:",omitempty"`
+	Minor string `yaml:",omitempty"`
+	// Symlink matches stable symlinks such as serial/by-id/* and grants
+	// the device nodes they point to. The resources are named after the
+	// symlinks, the nodes are available in the container at their own path
+	// unless ContainerPath is set, e.g. to /dev/$DEVICE for the symlink path.
+	Symlink bool `yaml:",omitempty"`
+	// Udev restricts the rule to the device files whose udev properties,
+	// e.g. ID_VENDOR_ID, ID_SERIAL or TAGS, match the regular expressions
+	Udev map[string]string `yaml:",omitempty"`
+	// Sysfs restricts the rule to the device files whose bound driver,
+	// subsystem or sysfs attributes match
+	Sysfs *SysfsMatch `yaml:",omitempty"`
+	// When restricts the rule to the nodes matching the conditions
+	When *RuleConditions `yaml:",omitempty"`
+	// Disabled removes the rule with the same key defined by an earlier
+	// file of a configuration directory
+	Disabled bool `yaml:",omitempty"`
+
+	// patterns, exclude, major, minor and udev are compiled from the fields
+	// above when the configuration is loaded, see compile. patterns holds
+	// DeviceMatch or the Composite patterns.
+	patterns []*regexp.Regexp
+	exclude  []*regexp.Regexp
+	major    numberRanges
+	minor    numberRanges
+	udev     map[string]*regexp.Regexp
+}
+
+// DeviceMount is a host path mounted in a container along with the devices
+type DeviceMount struct {
+	HostPath string
+	// ContainerPath defaults to HostPath
+	ContainerPath string `yaml:",omitempty"`
+	ReadOnly      bool   `yaml:",omitempty"`
+}
+
+// String identifies the rule in log and error messages
+func (d DesiredDevice) String() string {
+	if d.Name != "" {
+		return d.Name
+	}
+	if d.DeviceMatch != "" {
+		return d.DeviceMatch
+	}
+	var numbers []string
+	for _, n := range []struct{ name, value string }{{"type", d.Type}, {"major", d.Major}, {"minor", d.Minor}} {
+		if n.value != "" {
+			numbers = append(numbers, n.name+"="+n.value)
+		}
+	}
+	return strings.Join(numbers, " ")
+}
+
+// key identifies the rule when merging the files of a configuration
+// directory, a rule overrides or disables the rules of earlier files with the
+// same key. Rules without devicematch are required to have a name.
+func (d DesiredDevice) key() string {
+	if d.Name != "" {
+		return "name:" + d.Name
+	}
+	return "devicematch:" + d.DeviceMatch
+}
+
+// configDocument is the versioned configuration format
+type configDocument struct {
+	APIVersion string `yaml:"apiVersion"`
+	Kind       string `yaml:"kind"`
+	Devices    []DesiredDevice
+}
+
+// configuration is the parsed content of the configuration file together with
+// the raw bytes it was parsed from, used to detect actual changes
+type configuration struct {
+	raw            []byte
+	desiredDevices []DesiredDevice
+}
+
+// readConfiguration reads and parses the configuration file. If fileName is
+// a directory every *.yaml or *.yml file in it is read in lexical order and
+// their rules are merged: the first rule of a file with the same key as
+// rules of earlier files replaces them, or removes them if it is disabled.
+// Rules of a same file are all kept, even when they have the same key.
+func readConfiguration(fileName string) (*configuration, error) {
+	files, err := configurationFiles(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := &configuration{}
+	// index holds the positions of the rules of the files read so far by key
+	index := make(map[string][]int)
+	for _, file := range files {
+		yamlFile, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		conf.raw = append(conf.raw, []byte("# "+file+"\n")...)
+		conf.raw = append(conf.raw, yamlFile...)
+
+		desiredDevices, err := parseConfiguration(file, yamlFile)
+		if err != nil {
+			return nil, err
+		}
+
+		added := make(map[string][]int)
+		merged := make(map[string]bool)
+		for _, desiredDevice := range desiredDevices {
+			key := desiredDevice.key()
+			indices, defined := index[key]
+			switch {
+			case defined && !merged[key] && desiredDevice.Disabled:
+				glog.V(1).Infof("%s: disabling rule %s", file, desiredDevice)
+				for _, i := range indices {
+					conf.desiredDevices[i].Disabled = true
+				}
+				merged[key] = true
+			case defined && !merged[key]:
+				glog.V(1).Infof("%s: overriding rule %s", file, desiredDevice)
+				conf.desiredDevices[indices[0]] = desiredDevice
+				for _, i := range indices[1:] {
+					conf.desiredDevices[i].Disabled = true
+				}
+				index[key] = indices[:1]
+				merged[key] = true
+			case desiredDevice.Disabled && !defined:
+				glog.V(1).Infof("%s: rule %s to disable is not defined by an earlier file", file, desiredDevice)
+			case desiredDevice.Disabled:
+				// The rules of earlier files with this key are already merged
+			default:
+				added[key] = append(added[key], len(conf.desiredDevices))
+				conf.desiredDevices = append(conf.desiredDevices, desiredDevice)
+			}
+		}
+		for key, indices := range added {
+			index[key] = append(index[key], indices...)
+		}
+	}
+
+	// Disabled rules are kept until now so a later file can enable them again
+	var enabled []DesiredDevice
+	for _, desiredDevice := range conf.desiredDevices {
+		if !desiredDevice.Disabled {
+			enabled = append(enabled, desiredDevice)
+		}
+	}
+	conf.desiredDevices = enabled
+
+	return conf, nil
+}
+
+// configurationFiles returns the files making up the configuration
+func configurationFiles(fileName string) ([]string, error) {
+	fType, err := os.Stat(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if !fType.IsDir() {
+		return []string{fileName}, nil
+	}
+
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	var files []string
+	for _, name := range names {
+		if isConfigFileName(name) {
+			files = append(files, filepath.Join(fileName, name))
+		}
+	}
+	return files, nil
+}
+
+// isConfigFileName reports whether a file of a configuration directory is
+// read, hidden files such as the ..data entries of ConfigMaps are skipped
+func isConfigFileName(name string) bool {
+	return !strings.HasPrefix(name, ".") && (strings.HasSuffix(name, ".yaml") || strings.HasSuffix(name, ".yml"))
+}
+
+// effective returns the merged configuration in the versioned format
+func (c *configuration) effective() string {
+	var out bytes.Buffer
+	encoder := yaml.NewEncoder(&out)
+	encoder.SetIndent(2)
+	err := encoder.Encode(configDocument{
+		APIVersion: configAPIVersion,
+		Kind:       configKind,
+		Devices:    c.desiredDevices,
+	})
+	if err != nil {
+		return err.Error()
+	}
+	return out.String()
+}
+
+// parseConfiguration parses and validates a configuration document. Both
+// the versioned format and the plain list of rules used by earlier releases
+// are accepted, unknown fields are rejected.
+func parseConfiguration(fileName string, yamlFile []byte) ([]DesiredDevice, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(yamlFile, &root); err != nil {
+		return nil, fmt.Errorf("%s: %s", fileName, err)
+	}
+	if len(root.Content) == 0 {
+		return nil, nil
+	}
+
+	// ruleNodes are kept to report the line of the rules failing validation
+	var desiredDevices []DesiredDevice
+	var ruleNodes []*yaml.Node
+	document := root.Content[0]
+	switch document.Kind {
+	case yaml.SequenceNode:
+		if err := decodeStrict(yamlFile, &desiredDevices); err != nil {
+			return nil, fmt.Errorf("%s: %s", fileName, err)
+		}
+		ruleNodes = document.Content
+	case yaml.MappingNode:
+		var conf configDocument
+		if err := decodeStrict(yamlFile, &conf); err != nil {
+			return nil, fmt.Errorf("%s: %s", fileName, err)
+		}
+		if conf.APIVersion != configAPIVersion || conf.Kind != configKind {
+			return nil, fmt.Errorf("%s: line %d: unsupported configuration apiVersion %q and kind %q, expected %s and %s",
+				fileName, document.Line, conf.APIVersion, conf.Kind, configAPIVersion, configKind)
+		}
+		desiredDevices = conf.Devices
+		for i := 0; i+1 < len(document.Content); i += 2 {
+			if document.Content[i].Value == "devices" {
+				ruleNodes = document.Content[i+1].Content
+			}
+		}
+	default:
+		return nil, fmt.Errorf("%s: line %d: expected a configuration document or a list of rules", fileName, document.Line)
+	}
+
+	for i := range desiredDevices {
+		if err := desiredDevices[i].compile(); err != nil {
+			return nil, fmt.Errorf("%s: line %d: rule %s: %s", fileName, ruleNodes[i].Line, desiredDevices[i], err)
+		}
+	}
+
+	return desiredDevices, nil
+}
+
+// decodeStrict decodes a YAML document rejecting fields unknown to out
+func decodeStrict(yamlFile []byte, out interface{}) error {
+	decoder := yaml.NewDecoder(bytes.NewReader(yamlFile))
+	decoder.KnownFields(true)
+	err := decoder.Decode(out)
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+// compile checks that a rule is complete and consistent and compiles its
+// patterns, so matching devices never has to compile them again
+func (d *DesiredDevice) compile() error {
+	if d.Disabled {
+		if d.Name == "" && d.DeviceMatch == "" {
+			return fmt.Errorf("disabled rules require a name or devicematch")
+		}
+		return nil
+	}
+
+	patterns := d.Composite
+	switch {
+	case len(d.Composite) > 0:
+		if d.Name == "" {
+			return fmt.Errorf("composite resources require a name")
+		}
+		if d.DeviceMatch != "" || d.Pool {
+			return fmt.Errorf("composite cannot be combined with devicematch or pool")
+		}
+	case d.DeviceMatch == "" && d.Type == "" && d.Major == "" && d.Minor == "":
+		return fmt.Errorf("devicematch, composite, type, major or minor is required")
+	case d.DeviceMatch == "" && d.Name == "":
+		return fmt.Errorf("rules without devicematch require a name")
+	case d.DeviceMatch != "nvidia-gpu":
+		patterns = []string{d.DeviceMatch}
+	}
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern: %s", err)
+		}
+		d.patterns = append(d.patterns, re)
+	}
+	if d.DeviceMatch == "nvidia-gpu" && (d.Type != "" || d.Major != "" || d.Minor != "") {
+		return fmt.Errorf("type, major and minor cannot be used with nvidia-gpu")
+	}
+	if d.Type != "" && d.Type != entryChar && d.Type != entryBlock {
+		return fmt.Errorf("invalid type %q, expected char or block", d.Type)
+	}
+	for _, numbers := range []struct {
+		ranges string
+		parsed *numberRanges
+	}{{d.Major, &d.major}, {d.Minor, &d.minor}} {
+		if numbers.ranges == "" {
+			continue
+		}
+		parsed, err := parseNumberRanges(numbers.ranges)
+		if err != nil {
+			return err
+		}
+		*numbers.parsed = parsed
+	}
+	if len(d.Exclude) > 0 && d.DeviceMatch == "nvidia-gpu" {
+		return fmt.Errorf("exclude cannot be used with nvidia-gpu")
+	}
+	for _, pattern := range d.Exclude {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid exclude pattern: %s", err)
+		}
+		d.exclude = append(d.exclude, re)
+	}
+
+	if d.Pool && d.Name == "" {
+		return fmt.Errorf("pools require a name")
+	}
+	if !d.Pool && d.NumMaxDevices == 0 {
+		return fmt.Errorf("nummaxdevices must be at least 1")
+	}
+	if d.Domain != "" && !validDomain(d.Domain) {
+		return fmt.Errorf("invalid resource domain %q", d.Domain)
+	}
+	if d.ContainerPath != "" && !strings.HasPrefix(d.ContainerPath, "/") {
+		return fmt.Errorf("containerpath %s is not an absolute path", d.ContainerPath)
+	}
+	if d.Permissions != "" && !validPermissions(d.Permissions) {
+		return fmt.Errorf("invalid permissions %q, expected a combination of r, w and m such as r, rw or rwm", d.Permissions)
+	}
+	for name := range d.Env {
+		if name == "" || strings.ContainsAny(name, "=\x00") {
+			return fmt.Errorf("invalid environment variable name %q", name)
+		}
+	}
+	for _, mount := range d.Mounts {
+		if !filepath.IsAbs(mount.HostPath) {
+			return fmt.Errorf("mount hostpath %q is not an absolute path", mount.HostPath)
+		}
+		if mount.ContainerPath != "" && !filepath.IsAbs(mount.ContainerPath) {
+			return fmt.Errorf("mount containerpath %q is not an absolute path", mount.ContainerPath)
+		}
+	}
+	if d.Symlink && d.DeviceMatch == "nvidia-gpu" {
+		return fmt.Errorf("symlink cannot be used with nvidia-gpu")
+	}
+	if len(d.Udev) > 0 && d.DeviceMatch == "nvidia-gpu" {
+		return fmt.Errorf("udev properties cannot be matched for nvidia-gpu")
+	}
+	for property, pattern := range d.Udev {
+		if property == "" {
+			return fmt.Errorf("empty udev property name")
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern for udev property %s: %s", property, err)
+		}
+		if d.udev == nil {
+			d.udev = make(map[string]*regexp.Regexp)
+		}
+		d.udev[property] = re
+	}
+	if d.Sysfs != nil {
+		if d.DeviceMatch == "nvidia-gpu" {
+			return fmt.Errorf("sysfs entries cannot be matched for nvidia-gpu")
+		}
+		if err := d.Sysfs.compile(); err != nil {
+			return err
+		}
+	}
+	if _, err := newHealthMonitor(d.HealthCheck); err != nil {
+		return err
+	}
+	if d.When != nil {
+		if err := d.When.compile(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validDomain reports whether domain can be used as the prefix of an
+// extended resource name
+func validDomain(domain string) bool {
+	return len(domain) <= 253 && domainRegexp.MatchString(domain)
+}
+
+// validPermissions reports whether permissions is a cgroup device access
+// string: r, w and m each at most once
+func validPermissions(permissions string) bool {
+	seen := make(map[rune]bool)
+	for _, p := range permissions {
+		if !strings.ContainsRune("rwm", p) || seen[p] {
+			return false
+		}
+		seen[p] = true
+	}
+	return len(permissions) > 0
+}
+
+// sameAs reports whether both configurations were read from the same content
+func (c *configuration) sameAs(o *configuration) bool {
+	return bytes.Equal(c.raw, o.raw)
+}
+
+// newConfigWatcher watches the configuration directory, or the directory
+// holding the configuration file. Watching the directory rather than the
+// file catches editors replacing the file and the ..data symlink swap done
+// by kubelet on ConfigMap updates.
+func newConfigWatcher(fileName string) (*fsnotify.Watcher, error) {
+	if fType, err := os.Stat(fileName); err == nil && fType.IsDir() {
+		return newFSWatcher(fileName)
+	}
+	return newFSWatcher(filepath.Dir(fileName))
+}
+
+// isConfigEvent reports whether a watcher event may have changed the
+// content of the configuration
+func isConfigEvent(fileName string, event fsnotify.Event) bool {
+	if event.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Remove|fsnotify.Rename) == 0 {
+		return false
+	}
+	name := filepath.Base(event.Name)
+	if name == "..data" {
+		return true
+	}
+	if filepath.Dir(event.Name) == filepath.Clean(fileName) {
+		return isConfigFileName(name)
+	}
+	return name == filepath.Base(fileName)
+}
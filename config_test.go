@@ -0,0 +1,267 @@
+// Copyright (c) 2019, Arm Ltd
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeConfigFiles writes the given files into a new directory and returns it
+func writeConfigFiles(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// ruleNames lists the rules of a configuration as "rule:nummaxdevices"
+func ruleNames(conf *configuration) []string {
+	var names []string
+	for _, d := range conf.desiredDevices {
+		names = append(names, fmt.Sprintf("%s:%d", d, d.NumMaxDevices))
+	}
+	return names
+}
+
+func TestReadConfigurationMerge(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  []string
+	}{
+		{
+			name: "same devicematch in a single file",
+			files: map[string]string{"conf.yaml": `
+- devicematch: ^ttyUSB[0-9]*$
+  nummaxdevices: 1
+- devicematch: ^ttyUSB[0-9]*$
+  nummaxdevices: 2
+`},
+			want: []string{"^ttyUSB[0-9]*$:1", "^ttyUSB[0-9]*$:2"},
+		},
+		{
+			name: "rules without devicematch in a single file",
+			files: map[string]string{"conf.yaml": `
+- major: "189"
+  type: char
+  name: usb-$MINOR
+  nummaxdevices: 1
+- type: block
+  name: block-$DEVICE
+  nummaxdevices: 1
+`},
+			want: []string{"usb-$MINOR:1", "block-$DEVICE:1"},
+		},
+		{
+			name: "override from a later file",
+			files: map[string]string{
+				"00-base.yaml": `
+- devicematch: ^rtc0$
+  nummaxdevices: 1
+- devicematch: ^snd$
+  nummaxdevices: 1
+`,
+				"50-local.yaml": `
+- devicematch: ^rtc0$
+  nummaxdevices: 2
+`,
+			},
+			want: []string{"^rtc0$:2", "^snd$:1"},
+		},
+		{
+			name: "disable from a later file",
+			files: map[string]string{
+				"00-base.yaml": `
+- devicematch: ^rtc0$
+  nummaxdevices: 1
+- devicematch: ^snd$
+  nummaxdevices: 1
+`,
+				"50-local.yaml": `
+- devicematch: ^rtc0$
+  disabled: true
+`,
+			},
+			want: []string{"^snd$:1"},
+		},
+		{
+			name: "override of rules with the same key",
+			files: map[string]string{
+				"00-base.yaml": `
+- devicematch: ^rtc0$
+  nummaxdevices: 1
+- devicematch: ^rtc0$
+  nummaxdevices: 2
+`,
+				"50-local.yaml": `
+- devicematch: ^rtc0$
+  nummaxdevices: 3
+- devicematch: ^rtc0$
+  nummaxdevices: 4
+`,
+			},
+			want: []string{"^rtc0$:3", "^rtc0$:4"},
+		},
+		{
+			name: "enabled again by a later file",
+			files: map[string]string{
+				"00-base.yaml": `
+- name: serial
+  devicematch: ^ttyUSB[0-9]*$
+  nummaxdevices: 1
+- devicematch: ^snd$
+  nummaxdevices: 1
+`,
+				"50-local.yaml": `
+- name: serial
+  disabled: true
+`,
+				"90-node.yaml": `
+- name: serial
+  devicematch: ^ttyACM[0-9]*$
+  nummaxdevices: 2
+`,
+			},
+			want: []string{"serial:2", "^snd$:1"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := writeConfigFiles(t, test.files)
+			fileName := dir
+			if len(test.files) == 1 {
+				fileName = filepath.Join(dir, "conf.yaml")
+			}
+
+			conf, err := readConfiguration(fileName)
+			if err != nil {
+				t.Fatalf("readConfiguration: %s", err)
+			}
+			if got := ruleNames(conf); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got rules %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReadConfigurationRequiresName(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{"conf.yaml": `
+- major: "189"
+  type: char
+  nummaxdevices: 1
+`})
+
+	_, err := readConfiguration(filepath.Join(dir, "conf.yaml"))
+	if err == nil || !strings.Contains(err.Error(), "line 2") || !strings.Contains(err.Error(), "require a name") {
+		t.Errorf("got error %v, want a missing name error at line 2", err)
+	}
+}
+
+func TestParseConfiguration(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+		wantErr []string
+	}{
+		{
+			name: "list of rules",
+			content: `
+- devicematch: ^snd$
+  nummaxdevices: 20
+- devicematch: ^rtc0$
+  nummaxdevices: 1
+`,
+			want: []string{"^snd$:20", "^rtc0$:1"},
+		},
+		{
+			name: "versioned document",
+			content: `apiVersion: smarter-device-manager/v1
+kind: DeviceManagerConfig
+devices:
+- devicematch: ^snd$
+  nummaxdevices: 20
+`,
+			want: []string{"^snd$:20"},
+		},
+		{
+			name: "empty file",
+		},
+		{
+			name: "unknown field in a list",
+			content: `- devicematch: ^snd$
+  nummaxdevices: 20
+  nummaxdevice: 1
+`,
+			wantErr: []string{"conf.yaml", "line 3", "nummaxdevice"},
+		},
+		{
+			name: "unknown field in a document",
+			content: `apiVersion: smarter-device-manager/v1
+kind: DeviceManagerConfig
+device:
+- devicematch: ^snd$
+`,
+			wantErr: []string{"conf.yaml", "line 3", "device"},
+		},
+		{
+			name: "unsupported apiVersion",
+			content: `apiVersion: smarter-device-manager/v2
+kind: DeviceManagerConfig
+`,
+			wantErr: []string{"conf.yaml", "line 1", "unsupported configuration apiVersion"},
+		},
+		{
+			name: "invalid rule",
+			content: `- devicematch: ^snd$
+  nummaxdevices: 20
+- devicematch: ^rtc[0$
+  nummaxdevices: 1
+`,
+			wantErr: []string{"conf.yaml", "line 3", "^rtc[0$"},
+		},
+		{
+			name:    "scalar document",
+			content: "snd\n",
+			wantErr: []string{"conf.yaml", "line 1", "expected a configuration document or a list of rules"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			desiredDevices, err := parseConfiguration("conf.yaml", []byte(test.content))
+			if test.wantErr != nil {
+				if err == nil {
+					t.Fatalf("got no error, want an error containing %q", test.wantErr)
+				}
+				for _, want := range test.wantErr {
+					if !strings.Contains(err.Error(), want) {
+						t.Errorf("got error %q, want it to contain %q", err, want)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseConfiguration: %s", err)
+			}
+			if got := ruleNames(&configuration{desiredDevices: desiredDevices}); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got rules %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright (c) 2019, Arm Ltd
+
+package main
+
+import (
+	"sync"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// deviceState holds the current device list of a plugin and fans every
+// change out to all the ListAndWatch streams watching it. Each stream gets
+// a channel holding at most the latest list, so a slow or missing stream
+// never blocks the updates.
+type deviceState struct {
+	mu          sync.Mutex
+	devs        []*pluginapi.Device
+	subscribers map[chan []*pluginapi.Device]struct{}
+}
+
+func newDeviceState(devs []*pluginapi.Device) *deviceState {
+	return &deviceState{
+		devs:        devs,
+		subscribers: make(map[chan []*pluginapi.Device]struct{}),
+	}
+}
+
+// list returns a copy of the current device list
+func (s *deviceState) list() []*pluginapi.Device {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return copyDevices(s.devs)
+}
+
+// update applies fn to every device and broadcasts the resulting list
+func (s *deviceState) update(fn func(d *pluginapi.Device)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, d := range s.devs {
+		fn(d)
+	}
+	for updates := range s.subscribers {
+		publish(updates, copyDevices(s.devs))
+	}
+}
+
+// replace sets a new device list and broadcasts it, the devices that were
+// already listed keep their health
+func (s *deviceState) replace(devs []*pluginapi.Device) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	health := make(map[string]string)
+	for _, d := range s.devs {
+		health[d.ID] = d.Health
+	}
+	for _, d := range devs {
+		if h, ok := health[d.ID]; ok {
+			d.Health = h
+		}
+	}
+	s.devs = devs
+	for updates := range s.subscribers {
+		publish(updates, copyDevices(s.devs))
+	}
+}
+
+// subscribe returns a channel that receives the current device list and
+// then every change to it, and the function to call to stop receiving them
+func (s *deviceState) subscribe() (<-chan []*pluginapi.Device, func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	updates := make(chan []*pluginapi.Device, 1)
+	updates <- copyDevices(s.devs)
+	s.subscribers[updates] = struct{}{}
+
+	return updates, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		delete(s.subscribers, updates)
+	}
+}
+
+// publish replaces any list not yet consumed from updates with devs
+func publish(updates chan []*pluginapi.Device, devs []*pluginapi.Device) {
+	select {
+	case <-updates:
+	default:
+	}
+	updates <- devs
+}
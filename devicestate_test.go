@@ -0,0 +1,131 @@
+// Copyright (c) 2019, Arm Ltd
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// deviceHealths lists the devices of a list as "id:health"
+func deviceHealths(devs []*pluginapi.Device) []string {
+	var healths []string
+	for _, d := range devs {
+		healths = append(healths, d.ID+":"+d.Health)
+	}
+	return healths
+}
+
+// receive returns the list pending on updates, or nil if there is none
+func receive(updates <-chan []*pluginapi.Device) []string {
+	select {
+	case devs := <-updates:
+		return deviceHealths(devs)
+	default:
+		return nil
+	}
+}
+
+func TestDeviceState(t *testing.T) {
+	tests := []struct {
+		name    string
+		devs    []*pluginapi.Device
+		changes func(s *deviceState)
+		want    []string
+	}{
+		{
+			name: "initial snapshot",
+			devs: []*pluginapi.Device{{ID: "a", Health: pluginapi.Healthy}},
+			want: []string{"a:Healthy"},
+		},
+		{
+			name: "update",
+			devs: []*pluginapi.Device{{ID: "a", Health: pluginapi.Healthy}, {ID: "b", Health: pluginapi.Healthy}},
+			changes: func(s *deviceState) {
+				s.update(func(d *pluginapi.Device) {
+					if d.ID == "b" {
+						d.Health = pluginapi.Unhealthy
+					}
+				})
+			},
+			want: []string{"a:Healthy", "b:Unhealthy"},
+		},
+		{
+			name: "only the latest list is kept",
+			devs: []*pluginapi.Device{{ID: "a", Health: pluginapi.Healthy}},
+			changes: func(s *deviceState) {
+				s.update(func(d *pluginapi.Device) { d.Health = pluginapi.Unhealthy })
+				s.update(func(d *pluginapi.Device) { d.Health = pluginapi.Healthy })
+				s.update(func(d *pluginapi.Device) { d.Health = pluginapi.Unhealthy })
+			},
+			want: []string{"a:Unhealthy"},
+		},
+		{
+			name: "replace keeps the health of listed devices",
+			devs: []*pluginapi.Device{{ID: "a", Health: pluginapi.Unhealthy}, {ID: "b", Health: pluginapi.Healthy}},
+			changes: func(s *deviceState) {
+				s.replace([]*pluginapi.Device{{ID: "a", Health: pluginapi.Healthy}, {ID: "c", Health: pluginapi.Healthy}})
+			},
+			want: []string{"a:Unhealthy", "c:Healthy"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newDeviceState(test.devs)
+
+			var subscribers []<-chan []*pluginapi.Device
+			for i := 0; i < 3; i++ {
+				updates, unsubscribe := s.subscribe()
+				defer unsubscribe()
+				subscribers = append(subscribers, updates)
+			}
+			if test.changes != nil {
+				test.changes(s)
+			}
+
+			for i, updates := range subscribers {
+				if got := receive(updates); !reflect.DeepEqual(got, test.want) {
+					t.Errorf("subscriber %d: got %q, want %q", i, got, test.want)
+				}
+				if got := receive(updates); got != nil {
+					t.Errorf("subscriber %d: got a second list %q", i, got)
+				}
+			}
+			if got := deviceHealths(s.list()); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("list: got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDeviceStateUnsubscribe(t *testing.T) {
+	s := newDeviceState([]*pluginapi.Device{{ID: "a", Health: pluginapi.Healthy}})
+
+	kept, unsubscribeKept := s.subscribe()
+	defer unsubscribeKept()
+	removed, unsubscribe := s.subscribe()
+	receive(kept)
+	receive(removed)
+
+	unsubscribe()
+	s.update(func(d *pluginapi.Device) { d.Health = pluginapi.Unhealthy })
+
+	if got, want := receive(kept), []string{"a:Unhealthy"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("subscriber: got %q, want %q", got, want)
+	}
+	if got := receive(removed); got != nil {
+		t.Errorf("unsubscribed: got %q, want no list", got)
+	}
+}
+
+func TestDeviceStateListIsACopy(t *testing.T) {
+	s := newDeviceState([]*pluginapi.Device{{ID: "a", Health: pluginapi.Healthy}})
+
+	s.list()[0].Health = pluginapi.Unhealthy
+	if got, want := deviceHealths(s.list()), []string{"a:Healthy"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q after changing a listed device, want %q", got, want)
+	}
+}
@@ -0,0 +1,420 @@
+// Copyright (c) 2019, Arm Ltd
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+func sanitizeName(path string) string {
+	sanitizeChar := func(r rune) rune {
+		switch {
+		case r >= 'A' && r <= 'Z':
+			return r
+		case r >= 'a' && r <= 'z':
+			return r
+		case r >= '0' && r <= '9':
+			return r
+		case r == '_':
+			return r
+		case r == '-':
+			return r
+		}
+		return '_'
+	}
+	return strings.Map(sanitizeChar, path)
+}
+
+// deviceMatch is an entry found by a rule pattern
+type deviceMatch struct {
+	// name is the path of the entry relative to the scanned directory
+	name string
+	// entry describes the matched entry
+	entry devEntry
+	// target is the path relative to /dev of the device node a symlink
+	// resolves to, empty when the entry is used as is
+	target string
+	// vars are the template variables set by the match
+	vars map[string]string
+}
+
+// deviceNode is a device file granted to a container
+type deviceNode struct {
+	hostPath      string
+	containerPath string
+	permissions   string
+	// vars are the template variables set by the match of the node
+	vars map[string]string
+}
+
+// nvidiaGpuPattern matches the nvidia GPUs under /sys/devices
+var nvidiaGpuPattern = regexp.MustCompile("gpu.[0-9]*")
+
+func findDevicesPattern(listDevices []devEntry, re *regexp.Regexp) []deviceMatch {
+	var found []deviceMatch
+
+	for _, entry := range listDevices {
+		submatches := re.FindStringSubmatch(entry.name)
+		if submatches == nil {
+			continue
+		}
+
+		// Capture groups are available by number and by name, the whole
+		// match as $0, the device name as $DEVICE and the type and device
+		// numbers of the entry as $TYPE, $MAJOR and $MINOR
+		vars := entry.vars()
+		vars["DEVICE"] = entry.name
+		for i, name := range re.SubexpNames() {
+			vars[strconv.Itoa(i)] = submatches[i]
+			if name != "" {
+				vars[name] = submatches[i]
+			}
+		}
+		found = append(found, deviceMatch{name: entry.name, entry: entry, vars: vars})
+	}
+	return found
+}
+
+// orderRules returns the rules in precedence order: higher priorities first,
+// then in the order of the configuration
+func orderRules(desiredDevices []DesiredDevice) []DesiredDevice {
+	ordered := append([]DesiredDevice(nil), desiredDevices...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].Priority > ordered[j].Priority
+	})
+	return ordered
+}
+
+// excludedBy returns the first exclude pattern matching name, or the empty
+// string if none does
+func excludedBy(name string, exclude []*regexp.Regexp) string {
+	for _, re := range exclude {
+		if re.MatchString(name) {
+			return re.String()
+		}
+	}
+	return ""
+}
+
+// resolveSymlink sets the target of a match on a symlink to the device node
+// it points to
+func resolveSymlink(match *deviceMatch) error {
+	linkPath := "/dev/" + match.name
+	if match.entry.kind != entrySymlink {
+		return fmt.Errorf("%s is not a symlink", linkPath)
+	}
+	target, err := resolveHostSymlink(linkPath)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(target, "/dev/") {
+		return fmt.Errorf("%s points to %s outside of /dev", linkPath, target)
+	}
+
+	match.target = strings.TrimPrefix(target, "/dev/")
+	match.vars["TARGET"] = match.target
+	return nil
+}
+
+// matchedDeviceFile returns the host path of the device file of a match:
+// the device node a symlink points to rather than the symlink itself
+func matchedDeviceFile(match deviceMatch) string {
+	deviceFile := "/dev/" + match.name
+	if match.target != "" {
+		return "/dev/" + match.target
+	}
+	if match.entry.kind == entrySymlink {
+		if target, err := resolveHostSymlink(deviceFile); err == nil {
+			return target
+		}
+	}
+	return deviceFile
+}
+
+// matchDeviceNumbers reports whether the type and numbers of an entry match
+// the ones required by a rule, and if not why. Rules matching symlinks
+// check the device the symlink points to.
+func matchDeviceNumbers(entry devEntry, deviceToTest DesiredDevice) (bool, string) {
+	if deviceToTest.Type == "" && deviceToTest.major == nil && deviceToTest.minor == nil {
+		return true, ""
+	}
+
+	kind := entry.kind
+	if deviceToTest.Symlink {
+		kind = entry.deviceKind
+	}
+	if kind != entryChar && kind != entryBlock {
+		return false, fmt.Sprintf("%s is not a device", entry.kind)
+	}
+	if deviceToTest.Type != "" && kind != deviceToTest.Type {
+		return false, fmt.Sprintf("%s device is not a %s device", kind, deviceToTest.Type)
+	}
+	for _, number := range []struct {
+		name   string
+		ranges numberRanges
+		value  uint64
+		config string
+	}{
+		{"major", deviceToTest.major, entry.major, deviceToTest.Major},
+		{"minor", deviceToTest.minor, entry.minor, deviceToTest.Minor},
+	} {
+		if number.ranges == nil {
+			continue
+		}
+		if !number.ranges.contains(number.value) {
+			return false, fmt.Sprintf("%s %d is not in %s", number.name, number.value, number.config)
+		}
+	}
+	return true, ""
+}
+
+// filterDevices returns the devices found by a rule pattern whose device
+// files also match the properties required by the rule
+func filterDevices(found []deviceMatch, deviceToTest DesiredDevice) []deviceMatch {
+	var filtered []deviceMatch
+	for _, match := range found {
+		if ok, reason := matchDeviceNumbers(match.entry, deviceToTest); !ok {
+			glog.V(2).Infof("Device %s does not match %s: %s", match.name, deviceToTest, reason)
+			continue
+		}
+		if deviceToTest.Symlink {
+			if err := resolveSymlink(&match); err != nil {
+				glog.V(1).Infof("Device %s does not match %s: %s", match.name, deviceToTest, err)
+				continue
+			}
+		}
+		if excluded := excludedBy(match.name, deviceToTest.exclude); excluded != "" {
+			glog.V(1).Infof("Device %s is excluded from %s by %s", match.name, deviceToTest, excluded)
+			continue
+		}
+		deviceFile := localPath(matchedDeviceFile(match))
+		if ok, reason := matchUdevProperties(deviceFile, deviceToTest.udev); !ok {
+			glog.V(1).Infof("Device %s does not match %s: %s", match.name, deviceToTest, reason)
+			continue
+		}
+		if ok, reason := deviceToTest.Sysfs.matches(deviceFile); !ok {
+			glog.V(1).Infof("Device %s does not match %s: %s", match.name, deviceToTest, reason)
+			continue
+		}
+		filtered = append(filtered, match)
+	}
+	return filtered
+}
+
+// expandTemplate replaces $var and ${var} in template with the values of vars,
+// unknown variables expand to the empty string
+func expandTemplate(template string, vars map[string]string) string {
+	return os.Expand(template, func(name string) string {
+		return vars[name]
+	})
+}
+
+// newDeviceNode returns the device node granted for a device matched by a rule
+func newDeviceNode(match deviceMatch, deviceToTest DesiredDevice) deviceNode {
+	node := deviceNode{
+		hostPath:      "/dev/" + match.name,
+		containerPath: "/dev/" + match.name,
+		permissions:   "rw",
+		vars:          match.vars,
+	}
+	if match.target != "" {
+		node.hostPath = "/dev/" + match.target
+		node.containerPath = "/dev/" + match.target
+	}
+	if deviceToTest.Permissions != "" {
+		node.permissions = deviceToTest.Permissions
+	}
+	if deviceToTest.ContainerPath != "" {
+		node.containerPath = expandTemplate(deviceToTest.ContainerPath, match.vars)
+	}
+	return node
+}
+
+// newAllocationSettings returns the settings added to the allocations of the
+// devices of a rule
+func newAllocationSettings(deviceToTest DesiredDevice) allocationSettings {
+	return allocationSettings{
+		envs:        deviceToTest.Env,
+		annotations: deviceToTest.Annotations,
+		mounts:      deviceToTest.Mounts,
+	}
+}
+
+// containerPathConflict returns an error if two device nodes with different
+// host paths would be mounted on the same path in a container
+func containerPathConflict(nodes []deviceNode) error {
+	seen := make(map[string]string)
+	for _, node := range nodes {
+		if hostPath, ok := seen[node.containerPath]; ok && hostPath != node.hostPath {
+			return fmt.Errorf("devices %s and %s are both mapped to %s in the container", hostPath, node.hostPath, node.containerPath)
+		}
+		seen[node.containerPath] = node.hostPath
+	}
+	return nil
+}
+
+// checkContainerPaths warns about device nodes of a device instance that
+// would be mounted on the same path in a container. The nodes of a pool are
+// allocated separately, requests for several of them are refused by
+// Allocate, so that is just noted.
+func checkContainerPaths(device *DeviceInstance) {
+	if err := containerPathConflict(device.deviceNodes); err != nil {
+		if device.pool {
+			glog.V(1).Infof("Pool %s: %s, requests for more than one of them will be refused", device.name, err)
+		} else {
+			glog.Warningf("Device %s: %s", device.name, err)
+		}
+	}
+}
+
+// discoverDevices scans /dev and /sys/devices and returns the device
+// instances that match the desired devices
+func discoverDevices(desiredDevices []DesiredDevice) ([]*DeviceInstance, error) {
+	ExistingDevices, err := scanDirectory("/dev", 10, devScanSkip)
+	if err != nil {
+		return nil, err
+	}
+
+	ExistingDevicesSys, err := scanDirectory("/sys/devices", 0, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	facts := readNodeFacts()
+
+	var listDevicesAvailable []*DeviceInstance
+
+	// Rule providing each resource, the first rule in precedence order wins
+	// and the others are ignored for that resource
+	providedBy := make(map[string]DesiredDevice)
+
+	for _, deviceToTest := range orderRules(desiredDevices) {
+		deviceToTest := deviceToTest
+		addDevice := func(newDevice *DeviceInstance) bool {
+			resource := newDevice.domain + "/" + newDevice.name
+			if rule, ok := providedBy[resource]; ok {
+				glog.Warningf("Rule %s also provides %s, already provided by rule %s: ignoring it", deviceToTest, resource, rule)
+				return false
+			}
+			providedBy[resource] = deviceToTest
+			listDevicesAvailable = append(listDevicesAvailable, newDevice)
+			return true
+		}
+
+		if ok, reason := deviceToTest.When.matches(facts); !ok {
+			glog.V(1).Infof("Skipping rule %s on this node: %s", deviceToTest, reason)
+			continue
+		}
+
+		if deviceToTest.DeviceMatch == "nvidia-gpu" {
+			glog.V(1).Infof("Checking nvidia devices")
+			foundDevices := findDevicesPattern(ExistingDevicesSys, nvidiaGpuPattern)
+
+			// If found some create the devices entry
+			for _, deviceToCreate := range foundDevices {
+				deviceId := strings.TrimPrefix(deviceToCreate.name, "gpu.")
+				newDevice := &DeviceInstance{
+					domain:      resourceDomainOf(deviceToTest),
+					name:        "nvidia-gpu" + deviceId,
+					deviceId:    deviceId,
+					deviceNodes: []deviceNode{{hostPath: "/sys/devices/" + deviceToCreate.name}},
+					numDevices:  deviceToTest.NumMaxDevices,
+					deviceType:  nvidiaSysType,
+
+					healthCheck: deviceToTest.HealthCheck,
+				}
+				if addDevice(newDevice) {
+					glog.V(1).Infof("Found device %s with %s for %s", newDevice.name, newDevice.hostPaths(), deviceToTest)
+				}
+			}
+		} else if len(deviceToTest.Composite) > 0 {
+			glog.V(1).Infof("Checking devices %s on /dev for composite %s", strings.Join(deviceToTest.Composite, ", "), deviceToTest.Name)
+			newDevice := &DeviceInstance{
+				deviceType: deviceFileType,
+				domain:     resourceDomainOf(deviceToTest),
+				name:       deviceToTest.Name,
+				numDevices: deviceToTest.NumMaxDevices,
+
+				healthCheck: deviceToTest.HealthCheck,
+				settings:    newAllocationSettings(deviceToTest),
+			}
+
+			// Every pattern has to match for the composite to be complete
+			complete := true
+			for _, pattern := range deviceToTest.patterns {
+				foundDevices := filterDevices(findDevicesPattern(ExistingDevices, pattern), deviceToTest)
+				if len(foundDevices) == 0 {
+					glog.V(1).Infof("No device matches %s, not creating composite %s", pattern, deviceToTest.Name)
+					complete = false
+					break
+				}
+				for _, deviceToCreate := range foundDevices {
+					newDevice.deviceNodes = append(newDevice.deviceNodes, newDeviceNode(deviceToCreate, deviceToTest))
+				}
+			}
+			if complete {
+				checkContainerPaths(newDevice)
+				if addDevice(newDevice) {
+					glog.V(1).Infof("Found composite %s with devices %s", newDevice.name, newDevice.hostPaths())
+				}
+			}
+		} else if deviceToTest.Pool {
+			glog.V(1).Infof("Checking devices %s on /dev for pool %s", deviceToTest.DeviceMatch, deviceToTest.Name)
+			foundDevices := filterDevices(findDevicesPattern(ExistingDevices, deviceToTest.patterns[0]), deviceToTest)
+
+			// A pool is advertised even when empty so pods requesting it
+			// wait for a matching device to be plugged in
+			newDevice := &DeviceInstance{
+				deviceType: deviceFileType,
+				domain:     resourceDomainOf(deviceToTest),
+				name:       deviceToTest.Name,
+				pool:       true,
+
+				healthCheck: deviceToTest.HealthCheck,
+				settings:    newAllocationSettings(deviceToTest),
+			}
+			for _, deviceToCreate := range foundDevices {
+				newDevice.deviceNodes = append(newDevice.deviceNodes, newDeviceNode(deviceToCreate, deviceToTest))
+			}
+			checkContainerPaths(newDevice)
+			if addDevice(newDevice) {
+				glog.V(1).Infof("Found pool %s with %d devices for %s", newDevice.name, len(newDevice.deviceNodes), deviceToTest.DeviceMatch)
+			}
+		} else {
+			glog.V(1).Infof("Checking devices %s on /dev", deviceToTest)
+			foundDevices := filterDevices(findDevicesPattern(ExistingDevices, deviceToTest.patterns[0]), deviceToTest)
+
+			// If found some create the devices entry
+			for _, deviceToCreate := range foundDevices {
+				name := deviceToCreate.name
+				if deviceToTest.Name != "" {
+					name = expandTemplate(deviceToTest.Name, deviceToCreate.vars)
+				}
+				newDevice := &DeviceInstance{
+					deviceType:  deviceFileType,
+					domain:      resourceDomainOf(deviceToTest),
+					name:        name,
+					deviceNodes: []deviceNode{newDeviceNode(deviceToCreate, deviceToTest)},
+					numDevices:  deviceToTest.NumMaxDevices,
+
+					healthCheck: deviceToTest.HealthCheck,
+					settings:    newAllocationSettings(deviceToTest),
+				}
+				if addDevice(newDevice) {
+					glog.V(1).Infof("Found device %s with %s for %s", newDevice.name, newDevice.hostPaths(), deviceToTest.DeviceMatch)
+				}
+			}
+		}
+	}
+
+	assignResourceNames(listDevicesAvailable)
+
+	return listDevicesAvailable, nil
+}
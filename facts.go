@@ -0,0 +1,151 @@
+// Copyright (c) 2019, Arm Ltd
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"syscall"
+
+	"github.com/golang/glog"
+)
+
+// RuleConditions restricts a rule to the nodes whose facts match. Every
+// field is a regular expression and all the fields set have to match.
+type RuleConditions struct {
+	// Model is matched against /proc/device-tree/model
+	Model string `yaml:",omitempty"`
+	// Compatible is matched against each entry of /proc/device-tree/compatible
+	Compatible string `yaml:",omitempty"`
+	// Arch is matched against the machine reported by uname, e.g. aarch64
+	Arch string `yaml:",omitempty"`
+	// Kernel is matched against the kernel release, e.g. 5.10.104-tegra
+	Kernel string `yaml:",omitempty"`
+	// Hostname is matched against the node name given in the NODE_NAME
+	// environment variable, or the hostname of the container if it is unset
+	Hostname string `yaml:",omitempty"`
+
+	// The conditions compiled when the configuration is loaded, nil when
+	// they are not set
+	model, compatible, arch, kernel, hostname *regexp.Regexp
+}
+
+// nodeFacts describe the node the rules are evaluated on
+type nodeFacts struct {
+	model      string
+	compatible []string
+	arch       string
+	kernel     string
+	hostname   string
+}
+
+// readNodeFacts collects the facts of the node, facts that cannot be read
+// are left empty
+func readNodeFacts() nodeFacts {
+	var facts nodeFacts
+
+	if model, err := ioutil.ReadFile(localPath("/proc/device-tree/model")); err == nil {
+		facts.model = strings.TrimRight(string(model), "\x00\n")
+	}
+	if compatible, err := ioutil.ReadFile(localPath("/proc/device-tree/compatible")); err == nil {
+		for _, entry := range strings.Split(string(compatible), "\x00") {
+			if entry != "" {
+				facts.compatible = append(facts.compatible, entry)
+			}
+		}
+	}
+	if kernel, err := ioutil.ReadFile(localPath("/proc/sys/kernel/osrelease")); err == nil {
+		facts.kernel = strings.TrimSpace(string(kernel))
+	}
+
+	var uname syscall.Utsname
+	if err := syscall.Uname(&uname); err == nil {
+		var machine []byte
+		for _, c := range uname.Machine {
+			if c == 0 {
+				break
+			}
+			machine = append(machine, byte(c))
+		}
+		facts.arch = string(machine)
+	}
+
+	// The kubelet node name is given through the downward API, the hostname
+	// of the container depends on the UTS namespace it runs in
+	if nodeName := os.Getenv("NODE_NAME"); nodeName != "" {
+		facts.hostname = nodeName
+	} else if hostname, err := os.Hostname(); err == nil {
+		facts.hostname = hostname
+	} else {
+		glog.V(1).Infof("Could not read hostname: %s", err)
+	}
+
+	return facts
+}
+
+// compile checks that every condition is a valid regular expression and
+// compiles it
+func (c *RuleConditions) compile() error {
+	for _, condition := range []struct {
+		name    string
+		pattern string
+		re      **regexp.Regexp
+	}{
+		{"model", c.Model, &c.model},
+		{"compatible", c.Compatible, &c.compatible},
+		{"arch", c.Arch, &c.arch},
+		{"kernel", c.Kernel, &c.kernel},
+		{"hostname", c.Hostname, &c.hostname},
+	} {
+		if condition.pattern == "" {
+			continue
+		}
+		re, err := regexp.Compile(condition.pattern)
+		if err != nil {
+			return fmt.Errorf("invalid %s condition: %s", condition.name, err)
+		}
+		*condition.re = re
+	}
+	return nil
+}
+
+// matches reports whether the facts satisfy the conditions, and if not
+// the first condition that does not match
+func (c *RuleConditions) matches(facts nodeFacts) (bool, string) {
+	if c == nil {
+		return true, ""
+	}
+
+	single := []struct {
+		name  string
+		re    *regexp.Regexp
+		value string
+	}{
+		{"model", c.model, facts.model},
+		{"arch", c.arch, facts.arch},
+		{"kernel", c.kernel, facts.kernel},
+		{"hostname", c.hostname, facts.hostname},
+	}
+	for _, condition := range single {
+		if condition.re == nil {
+			continue
+		}
+		if !condition.re.MatchString(condition.value) {
+			return false, fmt.Sprintf("%s %q does not match %s", condition.name, condition.value, condition.re)
+		}
+	}
+
+	if c.compatible != nil {
+		for _, compatible := range facts.compatible {
+			if c.compatible.MatchString(compatible) {
+				return true, ""
+			}
+		}
+		return false, fmt.Sprintf("compatible %q does not match %s", strings.Join(facts.compatible, ","), c.compatible)
+	}
+
+	return true, ""
+}
@@ -0,0 +1,259 @@
+// Copyright (c) 2019, Arm Ltd
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const (
+	envDisableHealthChecks = "DP_DISABLE_HEALTHCHECKS"
+	allHealthChecks        = "exists,open,sysfs,exec"
+
+	defaultHealthCheckType     = "exists"
+	defaultHealthCheckInterval = 10 * time.Second
+)
+
+// HealthCheck describes how the health of the device files of a rule is probed
+type HealthCheck struct {
+	// Type is one of exists, open, sysfs or exec
+	Type string
+	// Interval between probes, e.g. "10s"
+	Interval string
+	// Attribute is the sysfs attribute read by the sysfs check, relative
+	// to the sysfs directory of the device or absolute
+	Attribute string
+	// Value is the content the sysfs attribute must have, any readable
+	// value is accepted if empty
+	Value string
+	// Command is run by the exec check with DEVICE_FILE set to the device
+	// file, the device is healthy if it exits with status 0
+	Command []string
+	// FailureThreshold is the number of consecutive failed probes needed
+	// to mark a healthy device unhealthy
+	FailureThreshold uint
+	// SuccessThreshold is the number of consecutive successful probes
+	// needed to mark an unhealthy device healthy again
+	SuccessThreshold uint
+}
+
+// healthChecker probes a single device file
+type healthChecker interface {
+	check(deviceFile string) error
+}
+
+type existsChecker struct{}
+
+func (c existsChecker) check(deviceFile string) error {
+	_, err := os.Stat(deviceFile)
+	return err
+}
+
+type openChecker struct{}
+
+func (c openChecker) check(deviceFile string) error {
+	f, err := os.OpenFile(deviceFile, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+type sysfsChecker struct {
+	attribute string
+	value     string
+}
+
+func (c sysfsChecker) check(deviceFile string) error {
+	attribute := localPath(c.attribute)
+	if !filepath.IsAbs(attribute) {
+		dir, err := sysfsDeviceDir(deviceFile)
+		if err != nil {
+			return err
+		}
+		attribute = filepath.Join(dir, attribute)
+	}
+	content, err := ioutil.ReadFile(attribute)
+	if err != nil {
+		return err
+	}
+	value := strings.TrimSpace(string(content))
+	if c.value != "" && value != c.value {
+		return fmt.Errorf("%s is %q, expected %q", attribute, value, c.value)
+	}
+	return nil
+}
+
+type execChecker struct {
+	command []string
+	timeout time.Duration
+}
+
+func (c execChecker) check(deviceFile string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, c.command[0], c.command[1:]...)
+	cmd.Env = append(os.Environ(), "DEVICE_FILE="+deviceFile)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// healthMonitor probes device files at a fixed interval and tracks their
+// health, only flipping it after the configured number of consecutive
+// failed or successful probes
+type healthMonitor struct {
+	checkType        string
+	checker          healthChecker
+	interval         time.Duration
+	failureThreshold uint
+	successThreshold uint
+
+	healthy map[string]bool
+	streak  map[string]uint
+}
+
+// newHealthMonitor builds the health monitor for a health check
+// configuration, the default exists check is used if conf is nil
+func newHealthMonitor(conf *HealthCheck) (*healthMonitor, error) {
+	if conf == nil {
+		conf = &HealthCheck{}
+	}
+
+	h := &healthMonitor{
+		checkType:        strings.ToLower(conf.Type),
+		interval:         defaultHealthCheckInterval,
+		failureThreshold: conf.FailureThreshold,
+		successThreshold: conf.SuccessThreshold,
+		healthy:          make(map[string]bool),
+		streak:           make(map[string]uint),
+	}
+	if h.checkType == "" {
+		h.checkType = defaultHealthCheckType
+	}
+	if h.failureThreshold == 0 {
+		h.failureThreshold = 1
+	}
+	if h.successThreshold == 0 {
+		h.successThreshold = 1
+	}
+	if conf.Interval != "" {
+		interval, err := time.ParseDuration(conf.Interval)
+		if err != nil {
+			return nil, fmt.Errorf("invalid health check interval %q: %s", conf.Interval, err)
+		}
+		if interval <= 0 {
+			return nil, fmt.Errorf("invalid health check interval %q: must be positive", conf.Interval)
+		}
+		h.interval = interval
+	}
+
+	switch h.checkType {
+	case "exists":
+		h.checker = existsChecker{}
+	case "open":
+		h.checker = openChecker{}
+	case "sysfs":
+		if conf.Attribute == "" {
+			return nil, fmt.Errorf("sysfs health check requires an attribute")
+		}
+		h.checker = sysfsChecker{attribute: conf.Attribute, value: conf.Value}
+	case "exec":
+		if len(conf.Command) == 0 {
+			return nil, fmt.Errorf("exec health check requires a command")
+		}
+		h.checker = execChecker{command: conf.Command, timeout: h.interval}
+	default:
+		return nil, fmt.Errorf("unknown health check type %q", conf.Type)
+	}
+
+	return h, nil
+}
+
+// disabled reports whether the check was turned off with DP_DISABLE_HEALTHCHECKS
+func (h *healthMonitor) disabled() bool {
+	disableHealthChecks := strings.ToLower(os.Getenv(envDisableHealthChecks))
+	if disableHealthChecks == "all" {
+		disableHealthChecks = allHealthChecks
+	}
+	for _, check := range strings.Split(disableHealthChecks, ",") {
+		if strings.TrimSpace(check) == h.checkType {
+			return true
+		}
+	}
+	return false
+}
+
+// probe checks every device file and returns whether the health of any of
+// them changed. Files that are not probed anymore, e.g. removed from a pool,
+// are forgotten.
+func (h *healthMonitor) probe(deviceFiles []string) bool {
+	probed := make(map[string]bool)
+	for _, deviceFile := range deviceFiles {
+		probed[deviceFile] = true
+	}
+	for deviceFile := range h.healthy {
+		if !probed[deviceFile] {
+			delete(h.healthy, deviceFile)
+			delete(h.streak, deviceFile)
+		}
+	}
+
+	changed := false
+	for _, deviceFile := range deviceFiles {
+		healthy, known := h.healthy[deviceFile]
+		if !known {
+			healthy = true
+			h.healthy[deviceFile] = true
+		}
+
+		err := h.checker.check(localPath(deviceFile))
+		if (err == nil) == healthy {
+			h.streak[deviceFile] = 0
+			continue
+		}
+
+		h.streak[deviceFile]++
+		threshold := h.failureThreshold
+		if !healthy {
+			threshold = h.successThreshold
+		}
+		if h.streak[deviceFile] < threshold {
+			continue
+		}
+
+		h.streak[deviceFile] = 0
+		h.healthy[deviceFile] = !healthy
+		changed = true
+		if err != nil {
+			glog.V(0).Infof("Device %s is unhealthy: %s", deviceFile, err)
+		} else {
+			glog.V(0).Infof("Device %s is healthy again", deviceFile)
+		}
+	}
+	return changed
+}
+
+// health returns the kubelet health of a device backed by the given files
+func (h *healthMonitor) health(deviceFiles []string) string {
+	for _, deviceFile := range deviceFiles {
+		if healthy, known := h.healthy[deviceFile]; known && !healthy {
+			return pluginapi.Unhealthy
+		}
+	}
+	return pluginapi.Healthy
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2019, Arm Ltd
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestHealthMonitorProbe(t *testing.T) {
+	tests := []struct {
+		name             string
+		failureThreshold uint
+		successThreshold uint
+		// exists is whether the device file exists at each probe
+		exists []bool
+		// want is the health after each probe
+		want []string
+	}{
+		{
+			name:   "default thresholds",
+			exists: []bool{true, false, true},
+			want:   []string{pluginapi.Healthy, pluginapi.Unhealthy, pluginapi.Healthy},
+		},
+		{
+			name:             "failure threshold",
+			failureThreshold: 3,
+			exists:           []bool{false, false, true, false, false, false},
+			want: []string{pluginapi.Healthy, pluginapi.Healthy, pluginapi.Healthy,
+				pluginapi.Healthy, pluginapi.Healthy, pluginapi.Unhealthy},
+		},
+		{
+			name:             "success threshold",
+			successThreshold: 2,
+			exists:           []bool{false, true, false, true, true},
+			want: []string{pluginapi.Unhealthy, pluginapi.Unhealthy, pluginapi.Unhealthy,
+				pluginapi.Unhealthy, pluginapi.Healthy},
+		},
+		{
+			name:             "both thresholds",
+			failureThreshold: 2,
+			successThreshold: 2,
+			exists:           []bool{false, false, true, false, true, true, false},
+			want: []string{pluginapi.Healthy, pluginapi.Unhealthy, pluginapi.Unhealthy,
+				pluginapi.Unhealthy, pluginapi.Unhealthy, pluginapi.Healthy, pluginapi.Healthy},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "health")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			deviceFile := filepath.Join(dir, "ttyUSB0")
+
+			h, err := newHealthMonitor(&HealthCheck{
+				FailureThreshold: test.failureThreshold,
+				SuccessThreshold: test.successThreshold,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			health := pluginapi.Healthy
+			for i, exists := range test.exists {
+				os.Remove(deviceFile)
+				if exists {
+					if err := ioutil.WriteFile(deviceFile, nil, 0644); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				changed := h.probe([]string{deviceFile})
+				got := h.health([]string{deviceFile})
+				if got != test.want[i] {
+					t.Errorf("probe %d: got %s, want %s", i, got, test.want[i])
+				}
+				if changed != (got != health) {
+					t.Errorf("probe %d: got changed %v, health went from %s to %s", i, changed, health, got)
+				}
+				health = got
+			}
+		})
+	}
+}
+
+func TestHealthMonitorForgetsFiles(t *testing.T) {
+	h, err := newHealthMonitor(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	missing := "/nonexistent/ttyUSB0"
+	if !h.probe([]string{missing}) {
+		t.Fatalf("probe of a missing file did not change its health")
+	}
+	if got := h.health([]string{missing}); got != pluginapi.Unhealthy {
+		t.Fatalf("got %s for a missing file, want %s", got, pluginapi.Unhealthy)
+	}
+
+	h.probe(nil)
+	if got := h.health([]string{missing}); got != pluginapi.Healthy {
+		t.Errorf("got %s for a file that is not probed anymore, want %s", got, pluginapi.Healthy)
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright (c) 2019, Arm Ltd
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/golang/glog"
+)
+
+// devWatcher watches a device tree for nodes being created or removed and
+// signals on Changes once the tree has been quiet for the settle delay, so a
+// burst of events caused by plugging a device triggers a single rescan.
+type devWatcher struct {
+	root    string
+	depth   int
+	skip    *scanSkip
+	settle  time.Duration
+	watcher *fsnotify.Watcher
+	Changes chan struct{}
+	stop    chan interface{}
+}
+
+func newDevWatcher(root string, depth int, skip *scanSkip, settle time.Duration) (*devWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	w := &devWatcher{
+		root:    root,
+		depth:   depth,
+		skip:    skip,
+		settle:  settle,
+		watcher: watcher,
+		Changes: make(chan struct{}, 1),
+		stop:    make(chan interface{}),
+	}
+
+	err = w.addTree(root)
+	if err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	go w.run()
+
+	return w, nil
+}
+
+// addTree adds a watch on dir and on every directory below it up to the
+// watcher depth, except the directories skipped by the scanner. Directory
+// symlinks are not followed.
+func (w *devWatcher) addTree(dir string) error {
+	rel, err := filepath.Rel(w.root, dir)
+	if err != nil {
+		return err
+	}
+	level := 0
+	if rel != "." {
+		level = strings.Count(rel, string(filepath.Separator)) + 1
+	}
+	if level > w.depth {
+		return nil
+	}
+	if rel != "." {
+		if reason := w.skip.skipped(filepath.ToSlash(rel), dir); reason != "" {
+			glog.V(2).Infof("hotplug: not watching %s: %s", dir, reason)
+			return nil
+		}
+	}
+
+	err = w.watcher.Add(dir)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	files, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		subDir := filepath.Join(dir, file)
+		fType, err := os.Lstat(subDir)
+		if err != nil || !fType.IsDir() {
+			continue
+		}
+		if err = w.addTree(subDir); err != nil {
+			glog.V(1).Infof("hotplug: not watching %s: %v", subDir, err)
+		}
+	}
+
+	return nil
+}
+
+func (w *devWatcher) run() {
+	timer := time.NewTimer(w.settle)
+	timer.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			timer.Stop()
+			return
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op&(fsnotify.Create|fsnotify.Remove|fsnotify.Rename) == 0 {
+				continue
+			}
+			glog.V(2).Infof("hotplug: %s", event)
+			if event.Op&fsnotify.Create == fsnotify.Create {
+				if fType, err := os.Lstat(event.Name); err == nil && fType.IsDir() {
+					if err = w.addTree(event.Name); err != nil {
+						glog.V(1).Infof("hotplug: not watching %s: %v", event.Name, err)
+					}
+				}
+			}
+			timer.Reset(w.settle)
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			glog.V(0).Infof("hotplug: %s", err)
+		case <-timer.C:
+			select {
+			case w.Changes <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// Close stops watching the device tree
+func (w *devWatcher) Close() error {
+	close(w.stop)
+	return w.watcher.Close()
+}
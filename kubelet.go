@@ -0,0 +1,76 @@
+// Copyright (c) 2019, Arm Ltd
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/glog"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const (
+	autoKubeletDir = "auto"
+
+	// kubeletProbeInterval is how often the candidate directories are probed
+	// for the kubelet socket in auto mode until it is found
+	kubeletProbeInterval = 5 * time.Second
+)
+
+// kubeletDirCandidates are the device plugin directories of the kubelet of
+// the known distributions, probed in order when -kubelet-dir is auto
+var kubeletDirCandidates = []string{
+	// kubeadm, recent k3s and most distributions
+	pluginapi.DevicePluginPath,
+	// k3s before it moved to the default kubelet directory
+	"/var/lib/rancher/k3s/agent/kubelet/device-plugins/",
+	"/var/snap/microk8s/common/var/lib/kubelet/device-plugins/",
+	"/var/lib/k0s/kubelet/device-plugins/",
+}
+
+// devicePluginPath is the kubelet device plugin directory in use, with a
+// trailing slash, where the plugin sockets are created
+var devicePluginPath = pluginapi.DevicePluginPath
+
+// kubeletSocket returns the path of the kubelet registration socket
+func kubeletSocket() string {
+	return filepath.Join(devicePluginPath, filepath.Base(pluginapi.KubeletSocket))
+}
+
+// findKubeletSocketDir returns the first candidate directory holding the
+// kubelet socket, or the empty string if kubelet is not running yet
+func findKubeletSocketDir() string {
+	socketName := filepath.Base(pluginapi.KubeletSocket)
+	for _, dir := range kubeletDirCandidates {
+		if _, err := os.Stat(filepath.Join(dir, socketName)); err == nil {
+			return dir
+		}
+	}
+	return ""
+}
+
+// detectKubeletDir returns the device plugin directory to use for the
+// -kubelet-dir flag. In auto mode it is the first candidate holding the
+// kubelet socket or, if kubelet is not running yet, the first existing one
+// until the socket appears, see findKubeletSocketDir.
+func detectKubeletDir(flagValue string) string {
+	if flagValue != autoKubeletDir {
+		return filepath.Clean(flagValue) + "/"
+	}
+
+	socketName := filepath.Base(pluginapi.KubeletSocket)
+	if dir := findKubeletSocketDir(); dir != "" {
+		glog.V(0).Infof("Found %s in %s", socketName, dir)
+		return dir
+	}
+	for _, dir := range kubeletDirCandidates {
+		if fType, err := os.Stat(dir); err == nil && fType.IsDir() {
+			glog.V(0).Infof("No %s found, using the existing directory %s", socketName, dir)
+			return dir
+		}
+	}
+	glog.V(0).Infof("No kubelet device plugin directory found, using %s", pluginapi.DevicePluginPath)
+	return pluginapi.DevicePluginPath
+}
@@ -5,40 +5,64 @@ package main
 import (
 	"flag"
 	"fmt"
-	"strings"
 	"os"
-	"regexp"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"syscall"
-        "io/ioutil"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/golang/glog"
-	"gopkg.in/yaml.v2"
-        pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
 
 var confFileName string
+var hotplugEnabled bool
+var hotplugDelay time.Duration
+var resourceDomain string
+var statusFileName string
+var scanSkipDirs string
+var scanSkipFilesystems string
+var devScanSkip *scanSkip
+var devRoot string
+var sysRoot string
+var procRoot string
+var kubeletDir string
+var maxParallelStarts int
 
 const (
-        deviceFileType uint = 0
-        nvidiaSysType uint = 1
+	deviceFileType uint = 0
+	nvidiaSysType  uint = 1
 )
 
+const defaultResourceDomain = "smarter-devices"
+
 type DeviceInstance struct {
 	devicePluginSmarter *SmarterDevicePlugin
-	devicePluginNvidia *NvidiaDevicePlugin
+	devicePluginNvidia  *NvidiaDevicePlugin
 
+	// domain and name are the resource name given by the rule, deviceName
+	// and socketName the valid names derived from them
+	domain     string
+	name       string
 	deviceName string
 	socketName string
-	deviceFile string
 	numDevices uint
-        deviceType uint
-        deviceId   string
-}
+	deviceType uint
+	deviceId   string
+	pool       bool
 
-type DesiredDevice struct {
-	DeviceMatch   string
-	NumMaxDevices uint
+	healthCheck *HealthCheck
+	settings    allocationSettings
+
+	// deviceNodes are only changed by the main loop, when the devices of a
+	// pool change, under nodesMu so the supervisor can read them
+	nodesMu     sync.Mutex
+	deviceNodes []deviceNode
+
+	supervisor *pluginSupervisor
 }
 
 func usage() {
@@ -49,250 +73,387 @@ func usage() {
 
 func init() {
 	flag.Usage = usage
-	// NOTE: This next line is key you have to call flag.Parse() for the command line
-	// options or "flags" that are defined in the glog module to be picked up.
-        flag.StringVar(&confFileName,"config","config/conf.yaml","set the configuration file to use")
-	flag.Parse()
+	flag.StringVar(&confFileName, "config", "config/conf.yaml", "set the configuration file, or directory of *.yaml and *.yml files merged in lexical order, to use")
+	flag.BoolVar(&hotplugEnabled, "hotplug", true, "watch /dev and add or remove devices as they are plugged or unplugged")
+	flag.DurationVar(&hotplugDelay, "hotplug-delay", time.Second, "time to wait for /dev to settle before rescanning devices")
+	flag.StringVar(&resourceDomain, "resource-domain", defaultResourceDomain, "set the domain of the resource names advertised to kubelet")
+	flag.StringVar(&kubeletDir, "kubelet-dir", autoKubeletDir, "set the kubelet device plugin directory, or auto to find it among the kubelet, k3s, microk8s and k0s locations")
+	flag.StringVar(&devRoot, "dev-root", "/dev", "set the path the host /dev is mounted at")
+	flag.StringVar(&sysRoot, "sys-root", "/sys", "set the path the host /sys is mounted at")
+	flag.StringVar(&procRoot, "proc-root", "/proc", "set the path the host /proc is mounted at")
+	flag.StringVar(&scanSkipDirs, "scan-skip-dirs", defaultScanSkipDirs, "comma separated directories, relative to /dev, not scanned for devices")
+	flag.StringVar(&scanSkipFilesystems, "scan-skip-fs", defaultScanSkipFilesystems, "comma separated filesystem types of the directories of /dev not scanned for devices")
+	flag.IntVar(&maxParallelStarts, "max-parallel-starts", defaultMaxParallelStarts, "maximum number of device plugins starting and registering with kubelet at the same time")
+	flag.StringVar(&statusFileName, "status-file", "", "write the advertised resources and the device files they grant to this file")
+}
+
+// sameDevice reports whether two device instances would be served by an
+// identical device plugin
+func (d *DeviceInstance) sameDevice(o *DeviceInstance) bool {
+	return d.samePlugin(o) && reflect.DeepEqual(d.deviceNodes, o.deviceNodes)
 }
 
-func readDevDirectory(dirToList string, allowedRecursions uint8) (files []string, err error) {
-        var foundFiles []string
-
-        fType, err := os.Stat(dirToList)
-        if err != nil {
-                return nil, err
-        }
-
-        if !fType.IsDir()  {
-                return nil, nil
-        }
-
-        f, err := os.Open(dirToList)
-        if err != nil {
-                return nil, err
-        }
-        files, err = f.Readdirnames(-1)
-        if err != nil {
-                f.Close()
-                return nil, err
-        }
-        f.Close()
-        for _, subDir := range files {
-                foundFiles = append(foundFiles, subDir)
-                if allowedRecursions > 0 {
-                        filesDir, err := readDevDirectory(dirToList+"/"+subDir,allowedRecursions-1)
-                        if err == nil {
-                                for _, fileName := range filesDir {
-                                        foundFiles = append(foundFiles, subDir+"/"+fileName)
-                                }
-                        }
-                }
-        }
-
-        return foundFiles, nil
+// samePlugin reports whether two device instances would be served by the
+// same device plugin, possibly with different device nodes
+func (d *DeviceInstance) samePlugin(o *DeviceInstance) bool {
+	return d.deviceName == o.deviceName &&
+		d.socketName == o.socketName &&
+		d.numDevices == o.numDevices &&
+		d.pool == o.pool &&
+		d.deviceType == o.deviceType &&
+		d.deviceId == o.deviceId &&
+		reflect.DeepEqual(d.healthCheck, o.healthCheck) &&
+		reflect.DeepEqual(d.settings, o.settings)
 }
 
-func sanitizeName(path string) string {
-        sanitizeChar := func(r rune) rune {
-		switch {
-		case r >= 'A' && r <= 'Z':
-			return r
-		case r >= 'a' && r <= 'z':
-			return r
-		case r >= '0' && r <= '9':
-			return r
-		case r == '_':
-			return r
-		case r == '-':
-			return r
+// hostPaths lists the host device files of a device instance for logging
+func (d *DeviceInstance) hostPaths() string {
+	var paths []string
+	for _, node := range d.deviceNodes {
+		paths = append(paths, node.hostPath)
+	}
+	return strings.Join(paths, ", ")
+}
+
+// pluginDevices returns the devices advertised for a device instance and the
+// device nodes granted for each of them. Pools advertise every device node as
+// a device of its own, other instances advertise numDevices devices all
+// granting every device node.
+func (d *DeviceInstance) pluginDevices() ([]*pluginapi.Device, map[string][]deviceNode) {
+	d.nodesMu.Lock()
+	defer d.nodesMu.Unlock()
+
+	deviceNodes := make(map[string][]deviceNode)
+	if d.pool {
+		var devs []*pluginapi.Device
+		for _, node := range d.deviceNodes {
+			// The matched name is stable when the rule matches symlinks,
+			// unlike the device node it points to
+			id := node.vars["DEVICE"]
+			devs = append(devs, &pluginapi.Device{
+				ID:     id,
+				Health: pluginapi.Healthy,
+			})
+			deviceNodes[id] = []deviceNode{node}
 		}
-		return '_'
+		return devs, deviceNodes
+	}
+
+	devs := getDevices(d.numDevices)
+	for _, dev := range devs {
+		deviceNodes[dev.ID] = d.deviceNodes
+	}
+	return devs, deviceNodes
+}
+
+// startDevice creates the device plugin for a device instance and registers it with kubelet
+func startDevice(device *DeviceInstance) error {
+	switch device.deviceType {
+	case deviceFileType:
+		devs, deviceNodes := device.pluginDevices()
+		device.devicePluginSmarter = NewSmarterDevicePlugin(devs, deviceNodes, device.deviceName, device.socketName, device.healthCheck, device.settings)
+		return device.devicePluginSmarter.Serve()
+	case nvidiaSysType:
+		device.devicePluginNvidia = NewNvidiaDevicePlugin(device.numDevices, device.deviceName, "NVIDIA_VISIBLE_DEVICES", device.socketName, device.deviceId, device.healthCheck)
+		return device.devicePluginNvidia.Serve()
 	}
-        return strings.Map(sanitizeChar, path)
+	return nil
 }
 
-func findDevicesPattern(listDevices []string, pattern string) ([]string,error) {
-	var found []string
-
-	for _, file := range listDevices {
-		res,err := regexp.MatchString(pattern, file)
-                if err != nil {
-                        return nil, err
-                }
-                if res {
-                        found = append(found, file)
-                }
+// setDeviceNodes replaces the device nodes of a device instance
+func (d *DeviceInstance) setDeviceNodes(nodes []deviceNode) {
+	d.nodesMu.Lock()
+	defer d.nodesMu.Unlock()
+
+	d.deviceNodes = nodes
+}
+
+// updateDevice sends the current devices of a device instance to its running
+// device plugin
+func updateDevice(device *DeviceInstance) {
+	if device.deviceType == deviceFileType && device.devicePluginSmarter != nil {
+		device.devicePluginSmarter.UpdateDevices(device.pluginDevices())
 	}
-	return found,nil
+}
+
+// stopDevice stops the device plugin of a device instance if it is running
+func stopDevice(device *DeviceInstance) {
+	switch device.deviceType {
+	case deviceFileType:
+		if device.devicePluginSmarter != nil {
+			device.devicePluginSmarter.Stop()
+			device.devicePluginSmarter = nil
+		}
+	case nvidiaSysType:
+		if device.devicePluginNvidia != nil {
+			device.devicePluginNvidia.Stop()
+			device.devicePluginNvidia = nil
+		}
+	}
+}
+
+// syncDevices brings the running devices in line with the devices found,
+// stopping the ones that disappeared, starting the new ones and leaving the
+// unchanged ones alone. Pools whose devices changed keep their plugin, which
+// advertises the new devices without registering again.
+func syncDevices(running map[string]*DeviceInstance, found []*DeviceInstance, changes chan<- struct{}) {
+	wanted := make(map[string]*DeviceInstance)
+	for _, device := range found {
+		wanted[device.deviceName] = device
+	}
+
+	var removed []*DeviceInstance
+	for name, device := range running {
+		newDevice, ok := wanted[name]
+		if ok && device.sameDevice(newDevice) {
+			continue
+		}
+		if ok && device.pool && device.deviceType == deviceFileType && device.samePlugin(newDevice) {
+			glog.V(0).Infof("Updating devices of %s (%s)", device.deviceName, newDevice.hostPaths())
+			device.setDeviceNodes(newDevice.deviceNodes)
+			device.supervisor.Update()
+			continue
+		}
+		glog.V(0).Infof("Removing device %s (%s)", device.deviceName, device.hostPaths())
+		removed = append(removed, device)
+		delete(running, name)
+	}
+	unsuperviseDevices(removed)
+
+	for name, device := range wanted {
+		if _, ok := running[name]; ok {
+			continue
+		}
+		glog.V(0).Infof("Adding device %s (%s)", device.deviceName, device.hostPaths())
+		running[name] = device
+		superviseDevice(device, changes)
+	}
+	writeStatus(running)
 }
 
 func main() {
+	// NOTE: This next line is key you have to call flag.Parse() for the command line
+	// options or "flags" that are defined in the glog module to be picked up.
+	// It is not called from init so the flags of go test are defined first.
+	flag.Parse()
 	defer glog.Flush()
 	glog.V(0).Info("Loading smarter-device-manager")
 
-	// Setting up the devices to check
-        var desiredDevices []DesiredDevice
-	glog.V(0).Info("Reading configuration file ",confFileName)
-        yamlFile, err := ioutil.ReadFile(confFileName)
-        if err != nil {
-                glog.Fatal("yamlFile.Get err   #%v ", err)
-        }
-        err = yaml.Unmarshal(yamlFile, &desiredDevices)
-        if err != nil {
-                glog.Fatal("Unmarshal: %v", err)
-                os.Exit(-1)
-        }
+	if !validDomain(resourceDomain) {
+		glog.Errorf("Invalid resource domain %s", resourceDomain)
+		os.Exit(1)
+	}
 
-	glog.V(0).Info("Reading existing devices on /dev")
-	ExistingDevices, err := readDevDirectory("/dev",10)
+	if maxParallelStarts < 1 {
+		glog.Errorf("Invalid -max-parallel-starts %d, must be at least 1", maxParallelStarts)
+		os.Exit(1)
+	}
+	startSlots = make(chan struct{}, maxParallelStarts)
+
+	devicePluginPath = detectKubeletDir(kubeletDir)
+	glog.V(0).Info("Using kubelet device plugin directory ", devicePluginPath)
+
+	var err error
+	devScanSkip, err = newScanSkip(scanSkipDirs, scanSkipFilesystems)
 	if err != nil {
-		glog.Errorf(err.Error())
+		glog.Errorf("Invalid -scan-skip-fs: %s", err)
 		os.Exit(1)
 	}
 
-	ExistingDevicesSys, err := readDevDirectory("/sys/devices",0)
+	// Setting up the devices to check
+	glog.V(0).Info("Reading configuration file ", confFileName)
+	conf, err := readConfiguration(confFileName)
+	if err != nil {
+		glog.Errorf("Could not read configuration file %s: %s", confFileName, err)
+		os.Exit(1)
+	}
+	glog.V(0).Infof("Effective configuration:\n%s", conf.effective())
+
+	glog.V(0).Info("Reading existing devices on /dev")
+	foundDevices, err := discoverDevices(conf.desiredDevices)
 	if err != nil {
 		glog.Errorf(err.Error())
 		os.Exit(1)
 	}
-	var listDevicesAvailable []DeviceInstance
-
-	for _, deviceToTest := range desiredDevices {
-                if deviceToTest.DeviceMatch == "nvidia-gpu" {
-                        glog.V(0).Infof("Checking nvidia devices")
-                        foundDevices,err := findDevicesPattern(ExistingDevicesSys, "gpu.[0-9]*")
-                        if err != nil {
-                                glog.Errorf(err.Error())
-                                os.Exit(1)
-                        }
-
-                        // If found some create the devices entry
-                        if len(foundDevices) > 0 {
-                                for _, deviceToCreate := range foundDevices {
-                                        var newDevice DeviceInstance
-                                        deviceId := strings.TrimPrefix(deviceToCreate,"gpu.")
-                                        newDevice.deviceName = "smarter-devices/" + "nvidia-gpu" + deviceId
-                                        newDevice.deviceId = deviceId
-                                        newDevice.socketName = pluginapi.DevicePluginPath + "smarter-nvidia-gpu" + deviceId + ".sock"
-                                        newDevice.deviceFile = deviceId
-                                        newDevice.numDevices = deviceToTest.NumMaxDevices
-                                        newDevice.deviceType = nvidiaSysType
-                                        listDevicesAvailable = append(listDevicesAvailable, newDevice)
-                                        glog.V(0).Infof("Creating device %s socket and %s name for %s",newDevice.deviceName,newDevice.deviceFile,deviceToTest.DeviceMatch)
-                                }
-                        }
-                } else {
-                        glog.V(0).Infof("Checking devices %s on /dev",deviceToTest.DeviceMatch)
-                        foundDevices,err := findDevicesPattern(ExistingDevices, deviceToTest.DeviceMatch)
-                        if err != nil {
-                                glog.Errorf(err.Error())
-                                os.Exit(1)
-                        }
-
-                        // If found some create the devices entry
-                        if len(foundDevices) > 0 {
-                                for _, deviceToCreate := range foundDevices {
-                                        var newDevice DeviceInstance
-                                        deviceSafeName := sanitizeName(deviceToCreate)
-                                        newDevice.deviceType = deviceFileType
-                                        newDevice.deviceName = "smarter-devices/" + deviceSafeName
-                                        newDevice.socketName = pluginapi.DevicePluginPath + "smarter-" + deviceSafeName + ".sock"
-                                        newDevice.deviceFile = "/dev/" + deviceToCreate
-                                        newDevice.numDevices = deviceToTest.NumMaxDevices
-                                        listDevicesAvailable = append(listDevicesAvailable, newDevice)
-                                        glog.V(0).Infof("Creating device %s socket and %s name for %s",newDevice.deviceName,newDevice.deviceFile,deviceToTest.DeviceMatch)
-                                }
-                        }
-                }
+
+	listDevicesAvailable := make(map[string]*DeviceInstance)
+	for _, device := range foundDevices {
+		glog.V(0).Infof("Creating device %s for %s with socket %s", device.deviceName, device.hostPaths(), device.socketName)
+		listDevicesAvailable[device.deviceName] = device
 	}
 
 	glog.V(0).Info("Starting FS watcher.")
-	watcher, err := newFSWatcher(pluginapi.DevicePluginPath)
+	watcher, err := newFSWatcher(devicePluginPath)
 	if err != nil {
 		glog.V(0).Info("Failed to created FS watcher.")
 		os.Exit(1)
 	}
-	defer watcher.Close()
+	defer func() { watcher.Close() }()
+
+	// In auto mode, until kubelet.sock is found the directory in use is only
+	// a guess, so the candidate directories are probed again
+	var kubeletProbe <-chan time.Time
+	if kubeletDir == autoKubeletDir && findKubeletSocketDir() == "" {
+		ticker := time.NewTicker(kubeletProbeInterval)
+		defer ticker.Stop()
+		kubeletProbe = ticker.C
+	}
+
+	glog.V(0).Info("Starting configuration watcher.")
+	confWatcher, err := newConfigWatcher(confFileName)
+	if err != nil {
+		glog.V(0).Infof("Failed to create configuration watcher: %s", err)
+		os.Exit(1)
+	}
+	defer confWatcher.Close()
+
+	// Every device plugin is run by its own supervisor, which signals the
+	// changes of state of the plugins to update the status file
+	stateChanges := make(chan struct{}, 1)
+
+	// reloadConfiguration rereads the configuration file and, if it changed,
+	// updates the devices whose rules were added, removed or modified
+	reloadConfiguration := func() {
+		newConf, err := readConfiguration(confFileName)
+		if err != nil {
+			glog.Errorf("Could not reload configuration file %s, keeping the current one: %s", confFileName, err)
+			return
+		}
+		if newConf.sameAs(conf) {
+			return
+		}
+		glog.V(0).Infof("Configuration file changed, updating devices. Effective configuration:\n%s", newConf.effective())
+		foundDevices, err := discoverDevices(newConf.desiredDevices)
+		if err != nil {
+			glog.Errorf("Could not apply new configuration, keeping the current one: %s", err)
+			return
+		}
+		conf = newConf
+		syncDevices(listDevicesAvailable, foundDevices, stateChanges)
+	}
+
+	var devChanges chan struct{}
+	if hotplugEnabled {
+		glog.V(0).Info("Starting hotplug watcher.")
+		devWatch, err := newDevWatcher(devRoot, 10, devScanSkip, hotplugDelay)
+		if err != nil {
+			glog.V(0).Infof("Failed to create hotplug watcher: %s", err)
+			os.Exit(1)
+		}
+		defer devWatch.Close()
+		devChanges = devWatch.Changes
+	}
 
 	glog.V(0).Info("Starting OS watcher.")
 	sigs := newOSWatcher(syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 
-	restart := true
+	// updateReadiness logs when every device plugin is registered, and when
+	// some of them are not anymore
+	startTime := time.Now()
+	ready := false
+	updateReadiness := func() {
+		registered, total := countRegistered(listDevicesAvailable)
+		if registered == total && !ready {
+			ready = true
+			glog.V(0).Infof("Ready: all %d device plugins registered with kubelet after %s", total, time.Since(startTime).Round(time.Millisecond))
+		} else if registered < total && ready {
+			ready = false
+			startTime = time.Now()
+			glog.V(0).Infof("Not ready: %d of %d device plugins registered with kubelet", registered, total)
+		}
+	}
 
-L:
-	for {
-		if restart {
-			for _, devicesInUse := range listDevicesAvailable {
-                                switch devicesInUse.deviceType {
-                                case deviceFileType :
-                                        if devicesInUse.devicePluginSmarter != nil {
-                                                devicesInUse.devicePluginSmarter.Stop()
-                                        }
-                                case nvidiaSysType :
-                                        if devicesInUse.devicePluginNvidia != nil {
-                                                devicesInUse.devicePluginNvidia.Stop()
-                                        }
-                                }
-			}
+	glog.V(0).Infof("Starting %d device plugins, %d at a time", len(listDevicesAvailable), maxParallelStarts)
+	for _, device := range listDevicesAvailable {
+		superviseDevice(device, stateChanges)
+	}
+	writeStatus(listDevicesAvailable)
+	updateReadiness()
 
-			var err error
-			for id, _ := range listDevicesAvailable {
-                                switch listDevicesAvailable[id].deviceType {
-                                case deviceFileType :
-                                        listDevicesAvailable[id].devicePluginSmarter = NewSmarterDevicePlugin(listDevicesAvailable[id].numDevices, listDevicesAvailable[id].deviceFile, listDevicesAvailable[id].deviceName, listDevicesAvailable[id].socketName)
-                                        if err = listDevicesAvailable[id].devicePluginSmarter.Serve(); err != nil {
-                                                glog.V(0).Info("Could not contact Kubelet, retrying. Did you enable the device plugin feature gate?")
-                                                break
-                                        }
-                                case nvidiaSysType :
-                                        listDevicesAvailable[id].devicePluginNvidia = NewNvidiaDevicePlugin(listDevicesAvailable[id].numDevices, listDevicesAvailable[id].deviceName,"NVIDIA_VISIBLE_DEVICES", listDevicesAvailable[id].socketName, listDevicesAvailable[id].deviceId)
-                                        if err = listDevicesAvailable[id].devicePluginNvidia.Serve(); err != nil {
-                                                glog.V(0).Info("Could not contact Kubelet, retrying. Did you enable the device plugin feature gate?")
-                                                break
-                                        }
-                                }
-			}
-			if err != nil {
-				continue
-			}
+	// restartDevices restarts every device plugin so they register again
+	restartDevices := func() {
+		for _, device := range listDevicesAvailable {
+			device.supervisor.Restart()
+		}
+	}
 
-			restart = false
+	// moveKubeletDir stops every device plugin and starts them again in the
+	// kubelet device plugin directory dir, where their sockets are created
+	moveKubeletDir := func(dir string) {
+		syncDevices(listDevicesAvailable, nil, stateChanges)
+		devicePluginPath = dir
+		watcher.Close()
+		watcher, err = newFSWatcher(devicePluginPath)
+		if err != nil {
+			glog.Errorf("Failed to create FS watcher on %s: %s", devicePluginPath, err)
+			os.Exit(1)
+		}
+		foundDevices, err := discoverDevices(conf.desiredDevices)
+		if err != nil {
+			glog.Errorf("Could not rescan devices: %s", err)
+			return
 		}
+		syncDevices(listDevicesAvailable, foundDevices, stateChanges)
+	}
 
+L:
+	for {
 		select {
 		case event := <-watcher.Events:
-			if event.Name == pluginapi.KubeletSocket && event.Op&fsnotify.Create == fsnotify.Create {
-				glog.V(0).Infof("inotify: %s created, restarting.", pluginapi.KubeletSocket)
-				restart = true
+			if event.Name == kubeletSocket() && event.Op&fsnotify.Create == fsnotify.Create {
+				glog.V(0).Infof("inotify: %s created, restarting.", kubeletSocket())
+				restartDevices()
 			}
 
 		case err := <-watcher.Errors:
 			glog.V(0).Infof("inotify: %s", err)
 
+		case <-kubeletProbe:
+			dir := findKubeletSocketDir()
+			if dir == "" {
+				continue
+			}
+			kubeletProbe = nil
+			if dir != devicePluginPath {
+				glog.V(0).Infof("Found %s in %s, moving the device plugins from %s", filepath.Base(kubeletSocket()), dir, devicePluginPath)
+				moveKubeletDir(dir)
+			}
+
+		case event := <-confWatcher.Events:
+			if isConfigEvent(confFileName, event) {
+				reloadConfiguration()
+			}
+
+		case err := <-confWatcher.Errors:
+			glog.V(0).Infof("inotify: %s", err)
+
+		case <-devChanges:
+			glog.V(1).Info("Changes detected on /dev, rescanning devices")
+			foundDevices, err := discoverDevices(conf.desiredDevices)
+			if err != nil {
+				glog.Errorf("Could not rescan devices: %s", err)
+				continue
+			}
+			syncDevices(listDevicesAvailable, foundDevices, stateChanges)
+
+		case <-stateChanges:
+			writeStatus(listDevicesAvailable)
+			updateReadiness()
+
 		case s := <-sigs:
 			switch s {
 			case syscall.SIGHUP:
-				glog.V(0).Info("Received SIGHUP, restarting.")
-				restart = true
+				glog.V(0).Info("Received SIGHUP, reloading configuration and restarting.")
+				reloadConfiguration()
+				restartDevices()
 			default:
 				glog.V(0).Infof("Received signal \"%v\", shutting down.", s)
-				for _, devicesInUse := range listDevicesAvailable {
-                                        glog.V(0).Info("Stopping device ", devicesInUse.deviceName)
-                                        switch devicesInUse.deviceType {
-                                        case deviceFileType :
-				                glog.V(0).Info("Smarter device type")
-                                                if devicesInUse.devicePluginSmarter != nil {
-				                        glog.V(0).Info("Stopping device")
-                                                        devicesInUse.devicePluginSmarter.Stop()
-                                                }
-                                        case nvidiaSysType :
-				                glog.V(0).Info("Nvidia device type")
-                                                if devicesInUse.devicePluginNvidia != nil {
-				                        glog.V(0).Info("Stopping device")
-                                                        devicesInUse.devicePluginNvidia.Stop()
-                                                }
-                                        }
+				var devicesInUse []*DeviceInstance
+				for _, device := range listDevicesAvailable {
+					glog.V(0).Info("Stopping device ", device.deviceName)
+					devicesInUse = append(devicesInUse, device)
 				}
+				unsuperviseDevices(devicesInUse)
 				break L
 			}
 		}
@@ -0,0 +1,101 @@
+// Copyright (c) 2019, Arm Ltd
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// maxResourceNameLength is the limit of the name part of an extended
+	// resource name
+	maxResourceNameLength = 63
+	// maxSocketPathLength is the limit of a unix socket path, including the
+	// terminating null byte
+	maxSocketPathLength = 108
+	// hashSuffixLength is the number of hex digits of the hash added to
+	// names that collide or are too long
+	hashSuffixLength = 8
+)
+
+// shortHash returns a short deterministic hash of s
+func shortHash(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:hashSuffixLength]
+}
+
+// trimName removes the characters a resource name cannot start or end with
+func trimName(name string) string {
+	return strings.Trim(name, "_-")
+}
+
+// withHashSuffix appends the hash of source to name, shortening name so the
+// result is at most maxLength long
+func withHashSuffix(name string, source string, maxLength int) string {
+	suffix := "-" + shortHash(source)
+	if len(name)+len(suffix) > maxLength {
+		name = trimName(name[:maxLength-len(suffix)])
+	}
+	return name + suffix
+}
+
+// safeResourceName returns the name part of the resource name advertised for
+// a device named name by its rule. Valid names are kept, names that have to
+// be sanitized or shortened get a hash suffix of the name, so the result
+// only depends on the name and not on the other devices of the node.
+func safeResourceName(name string) string {
+	safeName := trimName(sanitizeName(name))
+	if safeName == "" {
+		safeName = "device"
+	}
+	if safeName != name || len(safeName) > maxResourceNameLength {
+		safeName = withHashSuffix(safeName, name, maxResourceNameLength)
+	}
+	return safeName
+}
+
+// resourceDomainOf returns the domain of the resource names of a rule
+func resourceDomainOf(deviceToTest DesiredDevice) string {
+	if deviceToTest.Domain != "" {
+		return deviceToTest.Domain
+	}
+	return resourceDomain
+}
+
+// socketPath returns the plugin socket for a resource name
+func socketPath(domain string, safeName string) string {
+	socketName := "smarter-" + safeName
+	if domain != defaultResourceDomain {
+		socketName = "smarter-" + sanitizeName(domain) + "-" + safeName
+	}
+	maxLength := maxSocketPathLength - 1 - len(devicePluginPath) - len(".sock")
+	if len(socketName) > maxLength {
+		socketName = withHashSuffix(socketName, domain+"/"+safeName, maxLength)
+	}
+	return devicePluginPath + socketName + ".sock"
+}
+
+// assignResourceNames sets the resource name and socket of every device
+// instance from the domain and name given by its rule, see safeResourceName.
+// Sockets that still collide once shortened get a hash of the resource name.
+func assignResourceNames(devices []*DeviceInstance) {
+	sockets := make(map[string]string)
+	for _, device := range devices {
+		safeName := safeResourceName(device.name)
+		device.deviceName = device.domain + "/" + safeName
+		device.socketName = socketPath(device.domain, safeName)
+		if other, ok := sockets[device.socketName]; ok {
+			device.socketName = socketPath(device.domain, withHashSuffix(safeName, device.deviceName, maxResourceNameLength))
+			glog.Warningf("Socket of %s collides with the socket of %s, using %s", device.deviceName, other, device.socketName)
+		}
+		sockets[device.socketName] = device.deviceName
+
+		if safeName != device.name {
+			glog.V(1).Infof("Device name %s is advertised as %s", device.name, device.deviceName)
+		}
+	}
+}
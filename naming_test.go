@@ -0,0 +1,76 @@
+// Copyright (c) 2019, Arm Ltd
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAssignResourceNames(t *testing.T) {
+	longName := "serial/by-id/usb-Silicon_Labs_CP2102_USB_to_UART_Bridge_Controller_0001-if00-port0"
+
+	tests := []struct {
+		name  string
+		names []string
+		want  []string
+	}{
+		{
+			name:  "valid name",
+			names: []string{"ttyUSB0"},
+			want:  []string{"smarter-devices/ttyUSB0"},
+		},
+		{
+			name:  "sanitized name alone",
+			names: []string{"net/tun"},
+			want:  []string{"smarter-devices/net_tun-097969f1"},
+		},
+		{
+			name:  "sanitized name colliding with a valid name",
+			names: []string{"net/tun", "net_tun"},
+			want:  []string{"smarter-devices/net_tun-097969f1", "smarter-devices/net_tun"},
+		},
+		{
+			name:  "collision in the other order",
+			names: []string{"net_tun", "net/tun"},
+			want:  []string{"smarter-devices/net_tun", "smarter-devices/net_tun-097969f1"},
+		},
+		{
+			name:  "over-length name",
+			names: []string{longName},
+			want:  []string{"smarter-devices/serial_by-id_usb-Silicon_Labs_CP2102_USB_to_UART_Bridg-a07e00a8"},
+		},
+		{
+			name:  "invalid characters at the ends",
+			names: []string{"_gpio_"},
+			want:  []string{"smarter-devices/gpio-" + shortHash("_gpio_")},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var devices []*DeviceInstance
+			for _, name := range test.names {
+				devices = append(devices, &DeviceInstance{domain: defaultResourceDomain, name: name})
+			}
+			assignResourceNames(devices)
+
+			sockets := make(map[string]bool)
+			for i, device := range devices {
+				if device.deviceName != test.want[i] {
+					t.Errorf("%s: got resource name %s, want %s", device.name, device.deviceName, test.want[i])
+				}
+				if name := strings.TrimPrefix(device.deviceName, defaultResourceDomain+"/"); len(name) > maxResourceNameLength {
+					t.Errorf("%s: resource name %s is longer than %d", device.name, name, maxResourceNameLength)
+				}
+				if len(device.socketName) >= maxSocketPathLength {
+					t.Errorf("%s: socket %s is too long", device.name, device.socketName)
+				}
+				if sockets[device.socketName] {
+					t.Errorf("%s: socket %s is used twice", device.name, device.socketName)
+				}
+				sockets[device.socketName] = true
+			}
+		})
+	}
+}
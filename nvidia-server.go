@@ -7,7 +7,6 @@ import (
 	"net"
 	"os"
 	"path"
-	"strings"
 	"time"
 
 	"github.com/golang/glog"
@@ -20,30 +19,35 @@ var passDeviceSpecs = flag.Bool("pass-device-specs", false, "pass the list of De
 
 // NvidiaDevicePlugin implements the Kubernetes device plugin API
 type NvidiaDevicePlugin struct {
-	devs         []*pluginapi.Device
 	socket       string
 	resourceName   string
 	allocateEnvvar string
         id string
 
+	state   *deviceState
+	monitor *healthMonitor
 
-	stop   chan interface{}
-	health chan *pluginapi.Device
+	stop chan interface{}
 
 	server *grpc.Server
 }
 
 // NewNvidiaDevicePlugin returns an initialized NvidiaDevicePlugin
-func NewNvidiaDevicePlugin(nDevices uint, resourceName string, allocateEnvvar string, socket string, id string) *NvidiaDevicePlugin {
+func NewNvidiaDevicePlugin(nDevices uint, resourceName string, allocateEnvvar string, socket string, id string, healthCheck *HealthCheck) *NvidiaDevicePlugin {
+	monitor, err := newHealthMonitor(healthCheck)
+	if err != nil {
+		glog.Errorf("Health checks disabled for %s: %s", resourceName, err)
+	}
+
 	return &NvidiaDevicePlugin{
-                devs:            getDevices(nDevices),
+		state:           newDeviceState(getDevices(nDevices)),
 		resourceName:    resourceName,
 		allocateEnvvar:  allocateEnvvar,
 		socket:          socket,
 		id:              id,
+		monitor:         monitor,
 
-                stop:   make(chan interface{}),
-                health: make(chan *pluginapi.Device),
+		stop: make(chan interface{}),
 	}
 }
 
@@ -135,24 +139,23 @@ func (m *NvidiaDevicePlugin) Register(kubeletEndpoint, resourceName string) erro
 
 // ListAndWatch lists devices and update that list according to the health status
 func (m *NvidiaDevicePlugin) ListAndWatch(e *pluginapi.Empty, s pluginapi.DevicePlugin_ListAndWatchServer) error {
-	s.Send(&pluginapi.ListAndWatchResponse{Devices: m.devs})
+	updates, unsubscribe := m.state.subscribe()
+	defer unsubscribe()
 
 	for {
 		select {
 		case <-m.stop:
 			return nil
-		case d := <-m.health:
-			// FIXME: there is no way to recover from the Unhealthy state.
-			d.Health = pluginapi.Unhealthy
-			s.Send(&pluginapi.ListAndWatchResponse{Devices: m.devs})
+		case <-s.Context().Done():
+			return nil
+		case devs := <-updates:
+			if err := s.Send(&pluginapi.ListAndWatchResponse{Devices: devs}); err != nil {
+				return err
+			}
 		}
 	}
 }
 
-func (m *NvidiaDevicePlugin) unhealthy(dev *pluginapi.Device) {
-	m.health <- dev
-}
-
 // Allocate which return list of devices.
 func (m *NvidiaDevicePlugin) Allocate(ctx context.Context, reqs *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
 	responses := pluginapi.AllocateResponse{}
@@ -195,25 +198,25 @@ func (m *NvidiaDevicePlugin) cleanup() error {
 }
 
 func (m *NvidiaDevicePlugin) healthcheck() {
-	disableHealthChecks := strings.ToLower(os.Getenv(envDisableHealthChecks))
-	if disableHealthChecks == "all" {
-		disableHealthChecks = allHealthChecks
+	if m.monitor == nil || m.monitor.disabled() {
+		return
 	}
 
-	_, cancel := context.WithCancel(context.Background())
-
-	var xids chan *pluginapi.Device
-	if !strings.Contains(disableHealthChecks, "xids") {
-		xids = make(chan *pluginapi.Device)
-	}
+	deviceFiles := []string{"/sys/devices/gpu." + m.id}
+	ticker := time.NewTicker(m.monitor.interval)
+	defer ticker.Stop()
 
 	for {
 		select {
 		case <-m.stop:
-			cancel()
 			return
-		case dev := <-xids:
-			m.unhealthy(dev)
+		case <-ticker.C:
+			if m.monitor.probe(deviceFiles) {
+				health := m.monitor.health(deviceFiles)
+				m.state.update(func(d *pluginapi.Device) {
+					d.Health = health
+				})
+			}
 		}
 	}
 }
@@ -227,7 +230,7 @@ func (m *NvidiaDevicePlugin) Serve() error {
 	}
 	glog.V(0).Info("Starting to serve on", m.socket)
 
-	err = m.Register(pluginapi.KubeletSocket, m.resourceName)
+	err = m.Register(kubeletSocket(), m.resourceName)
 	if err != nil {
 		glog.Errorf("Could not register device plugin: %s", err)
 		m.Stop()
@@ -253,7 +256,7 @@ func (m *NvidiaDevicePlugin) apiDeviceSpecs(filter []string) []*pluginapi.Device
 	}
 
 	for _, p := range paths {
-		if _, err := os.Stat(p); err == nil {
+		if _, err := os.Stat(localPath(p)); err == nil {
 			spec := &pluginapi.DeviceSpec{
 				ContainerPath: p,
 				HostPath:      p,
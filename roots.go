@@ -0,0 +1,59 @@
+// Copyright (c) 2019, Arm Ltd
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const maxSymlinks = 40
+
+// hostRoots maps the host directories to the paths they are mounted at in
+// the container, set with -dev-root, -sys-root and -proc-root
+func hostRoots() []struct{ host, local string } {
+	return []struct{ host, local string }{
+		{"/dev", devRoot},
+		{"/sys", sysRoot},
+		{"/proc", procRoot},
+	}
+}
+
+// localPath returns the path through which a host path under /dev, /sys or
+// /proc is reached in the container. Device specs sent to kubelet always
+// use host paths.
+func localPath(hostPath string) string {
+	for _, root := range hostRoots() {
+		if hostPath == root.host || strings.HasPrefix(hostPath, root.host+"/") {
+			return root.local + strings.TrimPrefix(hostPath, root.host)
+		}
+	}
+	return hostPath
+}
+
+// resolveHostSymlink follows the symlink at a host path and returns the host
+// path it finally points to. Absolute targets are host paths too, so they
+// are looked up through the roots rather than in the container.
+func resolveHostSymlink(hostPath string) (string, error) {
+	path := hostPath
+	for i := 0; i < maxSymlinks; i++ {
+		fType, err := os.Lstat(localPath(path))
+		if err != nil {
+			return "", err
+		}
+		if fType.Mode()&os.ModeSymlink == 0 {
+			return path, nil
+		}
+		target, err := os.Readlink(localPath(path))
+		if err != nil {
+			return "", err
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(path), target)
+		}
+		path = filepath.Clean(target)
+	}
+	return "", fmt.Errorf("too many levels of symlinks resolving %s", hostPath)
+}
@@ -0,0 +1,254 @@
+// Copyright (c) 2019, Arm Ltd
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/golang/glog"
+)
+
+const (
+	defaultScanSkipDirs        = "shm,pts,mqueue,hugepages"
+	defaultScanSkipFilesystems = "devpts,mqueue,hugetlbfs"
+)
+
+// filesystemMagics are the statfs types of the pseudo-filesystems that can
+// be skipped by the scanner
+var filesystemMagics = map[string]uint32{
+	"devpts":     0x1cd1,
+	"mqueue":     0x19800202,
+	"hugetlbfs":  0x958458f6,
+	"tmpfs":      0x01021994,
+	"proc":       0x9fa0,
+	"sysfs":      0x62656572,
+	"debugfs":    0x64626720,
+	"securityfs": 0x73636673,
+	"bpf":        0xcafe4a11,
+}
+
+// Entry kinds recorded by the scanner
+const (
+	entryChar    = "char"
+	entryBlock   = "block"
+	entrySymlink = "symlink"
+	entryDir     = "dir"
+	entryFile    = "file"
+)
+
+// devEntry is an entry found by scanning a device tree
+type devEntry struct {
+	// name is the path of the entry relative to the scanned directory
+	name string
+	// kind is one of char, block, symlink, dir or file
+	kind string
+	// deviceKind, major and minor are the type and numbers of char and
+	// block devices, and of the device a symlink points to
+	deviceKind string
+	major      uint64
+	minor      uint64
+	// target is the content of a symlink
+	target string
+}
+
+// vars returns the template variables describing the entry
+func (e devEntry) vars() map[string]string {
+	vars := map[string]string{"TYPE": e.kind}
+	if e.deviceKind != "" {
+		vars["MAJOR"] = strconv.FormatUint(e.major, 10)
+		vars["MINOR"] = strconv.FormatUint(e.minor, 10)
+	}
+	return vars
+}
+
+// scanSkip holds the directories and filesystems the scanner does not descend into
+type scanSkip struct {
+	dirs        map[string]bool
+	filesystems map[uint32]string
+}
+
+// newScanSkip parses the comma separated lists of directories, relative to
+// the scanned directory, and of filesystem types to skip
+func newScanSkip(dirs string, filesystems string) (*scanSkip, error) {
+	s := &scanSkip{
+		dirs:        make(map[string]bool),
+		filesystems: make(map[uint32]string),
+	}
+	for _, dir := range strings.Split(dirs, ",") {
+		if dir = strings.Trim(strings.TrimSpace(dir), "/"); dir != "" {
+			s.dirs[dir] = true
+		}
+	}
+	for _, fs := range strings.Split(filesystems, ",") {
+		if fs = strings.TrimSpace(fs); fs == "" {
+			continue
+		}
+		magic, ok := filesystemMagics[fs]
+		if !ok {
+			return nil, fmt.Errorf("unknown filesystem type %q", fs)
+		}
+		s.filesystems[magic] = fs
+	}
+	return s, nil
+}
+
+// skipped reports why the directory at path, named name relative to the
+// scanned directory, must not be descended into, or the empty string
+func (s *scanSkip) skipped(name string, path string) string {
+	if s == nil {
+		return ""
+	}
+	if s.dirs[name] {
+		return "skipped directory"
+	}
+	if len(s.filesystems) > 0 {
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(path, &st); err == nil {
+			if fs, ok := s.filesystems[uint32(st.Type)]; ok {
+				return fs + " filesystem"
+			}
+		}
+	}
+	return ""
+}
+
+// scanDirectory lists the entries below the host directory dir, descending
+// at most depth levels of subdirectories. Symlinks are recorded but never
+// followed, and the directories skipped by skip are listed without their
+// content.
+func scanDirectory(dir string, depth int, skip *scanSkip) ([]devEntry, error) {
+	fType, err := os.Stat(localPath(dir))
+	if err != nil {
+		return nil, err
+	}
+	if !fType.IsDir() {
+		return nil, nil
+	}
+
+	var entries []devEntry
+	scanTree(dir, "", depth, skip, &entries)
+	return entries, nil
+}
+
+func scanTree(root string, prefix string, depth int, skip *scanSkip, entries *[]devEntry) {
+	dir := localPath(filepath.Join(root, prefix))
+	f, err := os.Open(dir)
+	if err != nil {
+		glog.V(1).Infof("Could not scan %s: %s", dir, err)
+		return
+	}
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		glog.V(1).Infof("Could not scan %s: %s", dir, err)
+		return
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if prefix != "" {
+			name = prefix + "/" + name
+		}
+		hostPath := filepath.Join(root, name)
+		entry, err := newDevEntry(name, hostPath)
+		if err != nil {
+			continue
+		}
+		*entries = append(*entries, entry)
+
+		if entry.kind != entryDir || depth <= 0 {
+			continue
+		}
+		if reason := skip.skipped(name, localPath(hostPath)); reason != "" {
+			glog.V(2).Infof("Not scanning %s: %s", localPath(hostPath), reason)
+			continue
+		}
+		scanTree(root, name, depth-1, skip, entries)
+	}
+}
+
+// newDevEntry describes the file at a host path without following it if it
+// is a symlink
+func newDevEntry(name string, hostPath string) (devEntry, error) {
+	entry := devEntry{name: name}
+
+	path := localPath(hostPath)
+	fType, err := os.Lstat(path)
+	if err != nil {
+		return entry, err
+	}
+
+	mode := fType.Mode()
+	switch {
+	case mode&os.ModeSymlink != 0:
+		entry.kind = entrySymlink
+		entry.target, _ = os.Readlink(path)
+		// Symlinks to devices carry the numbers of the device, absolute
+		// targets are host paths so they are resolved through the roots
+		if target, err := resolveHostSymlink(hostPath); err == nil {
+			if kind, major, minor, err := deviceNumber(localPath(target)); err == nil && kind != "" {
+				entry.deviceKind, entry.major, entry.minor = kind, major, minor
+			}
+		}
+		return entry, nil
+	case mode.IsDir():
+		entry.kind = entryDir
+		return entry, nil
+	case mode&os.ModeCharDevice != 0:
+		entry.kind = entryChar
+	case mode&os.ModeDevice != 0:
+		entry.kind = entryBlock
+	default:
+		entry.kind = entryFile
+		return entry, nil
+	}
+
+	if stat, ok := fType.Sys().(*syscall.Stat_t); ok {
+		entry.deviceKind = entry.kind
+		entry.major = devMajor(uint64(stat.Rdev))
+		entry.minor = devMinor(uint64(stat.Rdev))
+	}
+	return entry, nil
+}
+
+// numberRanges is a set of device numbers such as "4,188-189"
+type numberRanges [][2]uint64
+
+// parseNumberRanges parses a comma separated list of numbers and inclusive
+// ranges of numbers
+func parseNumberRanges(ranges string) (numberRanges, error) {
+	var parsed numberRanges
+	for _, r := range strings.Split(ranges, ",") {
+		r = strings.TrimSpace(r)
+		bounds := strings.SplitN(r, "-", 2)
+		low, err := strconv.ParseUint(strings.TrimSpace(bounds[0]), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number range %q", r)
+		}
+		high := low
+		if len(bounds) == 2 {
+			high, err = strconv.ParseUint(strings.TrimSpace(bounds[1]), 10, 32)
+			if err != nil || high < low {
+				return nil, fmt.Errorf("invalid number range %q", r)
+			}
+		}
+		parsed = append(parsed, [2]uint64{low, high})
+	}
+	return parsed, nil
+}
+
+// contains reports whether n is in one of the ranges
+func (ranges numberRanges) contains(n uint64) bool {
+	for _, r := range ranges {
+		if n >= r[0] && n <= r[1] {
+			return true
+		}
+	}
+	return false
+}
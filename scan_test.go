@@ -0,0 +1,195 @@
+// Copyright (c) 2019, Arm Ltd
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeDevTree creates a small device tree and makes it the host /dev
+func writeDevTree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldDevRoot := devRoot
+	devRoot = dir
+	t.Cleanup(func() {
+		devRoot = oldDevRoot
+		os.RemoveAll(dir)
+	})
+
+	for _, d := range []string{"pts", "snd/by-path"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{"ttyUSB0", "pts/0", "snd/controlC0", "snd/by-path/platform-soc"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, f), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{"sound": "snd", "gps0": "/dev/ttyUSB0"} {
+		if err := os.Symlink(target, filepath.Join(dir, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestScanDirectory(t *testing.T) {
+	tests := []struct {
+		name  string
+		dir   string
+		depth int
+		skip  string
+		want  []string
+	}{
+		{
+			name:  "top level only",
+			dir:   "/dev",
+			depth: 0,
+			want:  []string{"gps0:symlink", "pts:dir", "snd:dir", "sound:symlink", "ttyUSB0:file"},
+		},
+		{
+			name:  "one level",
+			dir:   "/dev",
+			depth: 1,
+			want: []string{"gps0:symlink", "pts:dir", "pts/0:file", "snd:dir", "snd/by-path:dir",
+				"snd/controlC0:file", "sound:symlink", "ttyUSB0:file"},
+		},
+		{
+			name:  "skipped directory",
+			dir:   "/dev",
+			depth: 2,
+			skip:  "pts",
+			want: []string{"gps0:symlink", "pts:dir", "snd:dir", "snd/by-path:dir", "snd/by-path/platform-soc:file",
+				"snd/controlC0:file", "sound:symlink", "ttyUSB0:file"},
+		},
+		{
+			name:  "skipped subdirectory",
+			dir:   "/dev",
+			depth: 2,
+			skip:  "pts,/snd/by-path/",
+			want: []string{"gps0:symlink", "pts:dir", "snd:dir", "snd/by-path:dir",
+				"snd/controlC0:file", "sound:symlink", "ttyUSB0:file"},
+		},
+		{
+			name:  "subdirectory",
+			dir:   "/dev/snd",
+			depth: 1,
+			want:  []string{"by-path:dir", "by-path/platform-soc:file", "controlC0:file"},
+		},
+		{
+			name: "not a directory",
+			dir:  "/dev/ttyUSB0",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			writeDevTree(t)
+			skip, err := newScanSkip(test.skip, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			entries, err := scanDirectory(test.dir, test.depth, skip)
+			if err != nil {
+				t.Fatalf("scanDirectory: %s", err)
+			}
+			var got []string
+			for _, entry := range entries {
+				got = append(got, entry.name+":"+entry.kind)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestScanDirectorySymlinks(t *testing.T) {
+	writeDevTree(t)
+
+	entries, err := scanDirectory("/dev", 0, nil)
+	if err != nil {
+		t.Fatalf("scanDirectory: %s", err)
+	}
+	targets := make(map[string]string)
+	for _, entry := range entries {
+		if entry.kind == entrySymlink {
+			targets[entry.name] = entry.target
+		}
+	}
+	want := map[string]string{"gps0": "/dev/ttyUSB0", "sound": "snd"}
+	if !reflect.DeepEqual(targets, want) {
+		t.Errorf("got symlinks %q, want %q", targets, want)
+	}
+}
+
+func TestNewScanSkip(t *testing.T) {
+	if _, err := newScanSkip("pts", "devpts,ext4"); err == nil {
+		t.Errorf("got no error for an unknown filesystem type")
+	}
+
+	skip, err := newScanSkip(" pts , /shm/,,", " devpts ,")
+	if err != nil {
+		t.Fatalf("newScanSkip: %s", err)
+	}
+	want := map[string]bool{"pts": true, "shm": true}
+	if !reflect.DeepEqual(skip.dirs, want) {
+		t.Errorf("got directories %v, want %v", skip.dirs, want)
+	}
+	if len(skip.filesystems) != 1 {
+		t.Errorf("got filesystems %v, want devpts only", skip.filesystems)
+	}
+}
+
+func TestParseNumberRanges(t *testing.T) {
+	tests := []struct {
+		ranges  string
+		wantErr bool
+		in      []uint64
+		out     []uint64
+	}{
+		{ranges: "4", in: []uint64{4}, out: []uint64{0, 3, 5}},
+		{ranges: "188-189", in: []uint64{188, 189}, out: []uint64{187, 190}},
+		{ranges: "4, 188 - 189", in: []uint64{4, 188, 189}, out: []uint64{5, 187, 190}},
+		{ranges: "7-7", in: []uint64{7}, out: []uint64{6, 8}},
+		{ranges: "", wantErr: true},
+		{ranges: "a", wantErr: true},
+		{ranges: "5-3", wantErr: true},
+		{ranges: "4,", wantErr: true},
+		{ranges: "-4", wantErr: true},
+		{ranges: "4-", wantErr: true},
+		{ranges: "4294967296", wantErr: true},
+	}
+
+	for _, test := range tests {
+		ranges, err := parseNumberRanges(test.ranges)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%q: got %v, want an error", test.ranges, ranges)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", test.ranges, err)
+			continue
+		}
+		for _, n := range test.in {
+			if !ranges.contains(n) {
+				t.Errorf("%q: %d is not contained", test.ranges, n)
+			}
+		}
+		for _, n := range test.out {
+			if ranges.contains(n) {
+				t.Errorf("%q: %d is contained", test.ranges, n)
+			}
+		}
+	}
+}
@@ -7,7 +7,7 @@ import (
 	"net"
 	"os"
 	"path"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang/glog"
@@ -16,34 +16,41 @@ import (
         pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
 
-const (
-	envDisableHealthChecks = "DP_DISABLE_HEALTHCHECKS"
-	allHealthChecks        = "xids"
-)
-
 // SmarterDevicePlugin implements the Kubernetes device plugin API
 type SmarterDevicePlugin struct {
-	devs         []*pluginapi.Device
 	socket       string
-	deviceFile   string
 	resourceName string
+	settings     allocationSettings
+
+	state   *deviceState
+	monitor *healthMonitor
 
-	stop   chan interface{}
-	health chan *pluginapi.Device
+	// mu guards deviceNodes, which is replaced when the devices of a pool change
+	mu          sync.Mutex
+	deviceNodes map[string][]deviceNode
+
+	stop chan interface{}
 
 	server *grpc.Server
 }
 
-// NewSmarterDevicePlugin returns an initialized SmarterDevicePlugin
-func NewSmarterDevicePlugin(nDevices uint, deviceFilename string, resourceIdentification string, serverSock string) *SmarterDevicePlugin {
+// NewSmarterDevicePlugin returns an initialized SmarterDevicePlugin, deviceNodes
+// maps the ID of each device to the device nodes granted when it is allocated
+func NewSmarterDevicePlugin(devs []*pluginapi.Device, deviceNodes map[string][]deviceNode, resourceIdentification string, serverSock string, healthCheck *HealthCheck, settings allocationSettings) *SmarterDevicePlugin {
+	monitor, err := newHealthMonitor(healthCheck)
+	if err != nil {
+		glog.Errorf("Health checks disabled for %s: %s", resourceIdentification, err)
+	}
+
 	return &SmarterDevicePlugin{
-		devs:         getDevices(nDevices),
+		state:        newDeviceState(devs),
 		socket:       serverSock,
-		deviceFile:   deviceFilename,
+		deviceNodes:  deviceNodes,
 		resourceName: resourceIdentification,
+		settings:     settings,
+		monitor:      monitor,
 
-		stop:   make(chan interface{}),
-		health: make(chan *pluginapi.Device),
+		stop: make(chan interface{}),
 	}
 }
 
@@ -131,38 +138,39 @@ func (m *SmarterDevicePlugin) Register(kubeletEndpoint, resourceName string) err
 
 // ListAndWatch lists devices and update that list according to the health status
 func (m *SmarterDevicePlugin) ListAndWatch(e *pluginapi.Empty, s pluginapi.DevicePlugin_ListAndWatchServer) error {
-	s.Send(&pluginapi.ListAndWatchResponse{Devices: m.devs})
+	updates, unsubscribe := m.state.subscribe()
+	defer unsubscribe()
 
 	for {
 		select {
 		case <-m.stop:
 			return nil
-		case d := <-m.health:
-			// FIXME: there is no way to recover from the Unhealthy state.
-			d.Health = pluginapi.Unhealthy
-			s.Send(&pluginapi.ListAndWatchResponse{Devices: m.devs})
+		case <-s.Context().Done():
+			return nil
+		case devs := <-updates:
+			if err := s.Send(&pluginapi.ListAndWatchResponse{Devices: devs}); err != nil {
+				return err
+			}
 		}
 	}
 }
 
-func (m *SmarterDevicePlugin) unhealthy(dev *pluginapi.Device) {
-	m.health <- dev
+// UpdateDevices replaces the devices of the running plugin and sends the new
+// list to kubelet without registering again
+func (m *SmarterDevicePlugin) UpdateDevices(devs []*pluginapi.Device, deviceNodes map[string][]deviceNode) {
+	m.mu.Lock()
+	m.deviceNodes = deviceNodes
+	m.mu.Unlock()
+
+	m.state.replace(devs)
 }
 
 // Allocate which return list of devices.
 func (m *SmarterDevicePlugin) Allocate(ctx context.Context, reqs *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
-	devs := m.devs
+	devs := m.state.list()
 	responses := pluginapi.AllocateResponse{}
 	for _, req := range reqs.ContainerRequests {
-		response := pluginapi.ContainerAllocateResponse{
-			Devices: []*pluginapi.DeviceSpec{
-				&pluginapi.DeviceSpec{
-					ContainerPath: m.deviceFile,
-					HostPath:      m.deviceFile,
-					Permissions:   "rw",
-				},
-			},
-		}
+		response := pluginapi.ContainerAllocateResponse{}
 
 		for _, id := range req.DevicesIDs {
 			if !deviceExists(devs, id) {
@@ -170,12 +178,75 @@ func (m *SmarterDevicePlugin) Allocate(ctx context.Context, reqs *pluginapi.Allo
 			}
 		}
 
+		nodes := m.allocatedNodes(req.DevicesIDs)
+		if err := containerPathConflict(nodes); err != nil {
+			return nil, fmt.Errorf("invalid allocation request: %s", err)
+		}
+		for _, node := range nodes {
+			response.Devices = append(response.Devices, &pluginapi.DeviceSpec{
+				ContainerPath: node.containerPath,
+				HostPath:      node.hostPath,
+				Permissions:   node.permissions,
+			})
+		}
+
+		vars := allocationVariables(m.resourceName, req.DevicesIDs, nodes)
+		response.Envs = expandSettings(m.settings.envs, vars)
+		response.Annotations = expandSettings(m.settings.annotations, vars)
+		response.Mounts = m.settings.apiMounts()
+
 		responses.ContainerResponses = append(responses.ContainerResponses, &response)
 	}
 
 	return &responses, nil
 }
 
+// allocatedNodes returns the device nodes backing the given device IDs,
+// without duplicates
+func (m *SmarterDevicePlugin) allocatedNodes(ids []string) []deviceNode {
+	var nodes []deviceNode
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		for _, node := range m.nodes(id) {
+			key := node.hostPath + ":" + node.containerPath
+			if !seen[key] {
+				seen[key] = true
+				nodes = append(nodes, node)
+			}
+		}
+	}
+	return nodes
+}
+
+// nodes returns the device nodes granted for a device ID
+func (m *SmarterDevicePlugin) nodes(id string) []deviceNode {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.deviceNodes[id]
+}
+
+// deviceFiles returns the host device files of every device of the plugin
+func (m *SmarterDevicePlugin) deviceFiles() []string {
+	m.mu.Lock()
+	var ids []string
+	for id := range m.deviceNodes {
+		ids = append(ids, id)
+	}
+	m.mu.Unlock()
+
+	return hostPaths(m.allocatedNodes(ids))
+}
+
+// hostPaths returns the host device files of the given device nodes
+func hostPaths(nodes []deviceNode) []string {
+	var paths []string
+	for _, node := range nodes {
+		paths = append(paths, node.hostPath)
+	}
+	return paths
+}
+
 func (m *SmarterDevicePlugin) PreStartContainer(context.Context, *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
 	return &pluginapi.PreStartContainerResponse{}, nil
 }
@@ -194,25 +265,23 @@ func (m *SmarterDevicePlugin) cleanup() error {
 }
 
 func (m *SmarterDevicePlugin) healthcheck() {
-	disableHealthChecks := strings.ToLower(os.Getenv(envDisableHealthChecks))
-	if disableHealthChecks == "all" {
-		disableHealthChecks = allHealthChecks
+	if m.monitor == nil || m.monitor.disabled() {
+		return
 	}
 
-	_, cancel := context.WithCancel(context.Background())
-
-	var xids chan *pluginapi.Device
-	if !strings.Contains(disableHealthChecks, "xids") {
-		xids = make(chan *pluginapi.Device)
-	}
+	ticker := time.NewTicker(m.monitor.interval)
+	defer ticker.Stop()
 
 	for {
 		select {
 		case <-m.stop:
-			cancel()
 			return
-		case dev := <-xids:
-			m.unhealthy(dev)
+		case <-ticker.C:
+			if m.monitor.probe(m.deviceFiles()) {
+				m.state.update(func(d *pluginapi.Device) {
+					d.Health = m.monitor.health(hostPaths(m.nodes(d.ID)))
+				})
+			}
 		}
 	}
 }
@@ -226,7 +295,7 @@ func (m *SmarterDevicePlugin) Serve() error {
 	}
 	glog.V(0).Info("Starting to serve on", m.socket)
 
-	err = m.Register(pluginapi.KubeletSocket, m.resourceName)
+	err = m.Register(kubeletSocket(), m.resourceName)
 	if err != nil {
 		glog.Errorf("Could not register device plugin: %s", err)
 		m.Stop()
@@ -0,0 +1,109 @@
+// Copyright (c) 2019, Arm Ltd
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/golang/glog"
+	"gopkg.in/yaml.v3"
+)
+
+// statusDocument is the content of the status file
+type statusDocument struct {
+	// Ready is set once every device plugin is registered with kubelet
+	Ready     bool
+	Resources []resourceStatus
+}
+
+// resourceStatus describes a resource advertised to kubelet in the status file
+type resourceStatus struct {
+	// Resource is the resource name advertised to kubelet
+	Resource string
+	// Name is the name given by the rule the resource name is derived from
+	Name   string
+	Socket string
+	// Devices are the host device files granted by the resource
+	Devices []string `yaml:",omitempty"`
+	// State is the state of the device plugin and Error the reason it
+	// last failed to start
+	State string `yaml:",omitempty"`
+	Error string `yaml:",omitempty"`
+}
+
+// writeStatus writes the resources currently advertised to the status file
+// set with -status-file, if any. The file is replaced atomically so readers
+// never see a partial status.
+func writeStatus(devices map[string]*DeviceInstance) {
+	if statusFileName == "" {
+		return
+	}
+
+	var resources []resourceStatus
+	for _, device := range devices {
+		status := resourceStatus{
+			Resource: device.deviceName,
+			Name:     device.name,
+			Socket:   device.socketName,
+		}
+		for _, node := range device.deviceNodes {
+			status.Devices = append(status.Devices, node.hostPath)
+		}
+		if device.supervisor != nil {
+			state, err := device.supervisor.status()
+			status.State = state.String()
+			if err != nil {
+				status.Error = err.Error()
+			}
+		}
+		resources = append(resources, status)
+	}
+	sort.Slice(resources, func(i, j int) bool {
+		return resources[i].Resource < resources[j].Resource
+	})
+
+	var out bytes.Buffer
+	encoder := yaml.NewEncoder(&out)
+	encoder.SetIndent(2)
+	registered, total := countRegistered(devices)
+	if err := encoder.Encode(statusDocument{Ready: registered == total, Resources: resources}); err != nil {
+		glog.Errorf("Could not encode status: %s", err)
+		return
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(statusFileName), "."+filepath.Base(statusFileName))
+	if err != nil {
+		glog.Errorf("Could not write status file %s: %s", statusFileName, err)
+		return
+	}
+	_, err = tmp.Write(out.Bytes())
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), statusFileName)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		glog.Errorf("Could not write status file %s: %s", statusFileName, err)
+	}
+}
+
+// countRegistered returns the number of device plugins registered with
+// kubelet and the total number of device plugins
+func countRegistered(devices map[string]*DeviceInstance) (int, int) {
+	registered := 0
+	for _, device := range devices {
+		if device.supervisor == nil {
+			continue
+		}
+		if state, _ := device.supervisor.status(); state == pluginRegistered {
+			registered++
+		}
+	}
+	return registered, len(devices)
+}
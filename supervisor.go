@@ -0,0 +1,224 @@
+// Copyright (c) 2019, Arm Ltd
+
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	initialRestartBackoff = time.Second
+	maxRestartBackoff     = 2 * time.Minute
+
+	defaultMaxParallelStarts = 16
+)
+
+// startSlots bounds the number of device plugins starting and registering
+// at the same time, it is unbounded when nil
+var startSlots chan struct{}
+
+// pluginState is the lifecycle state of the device plugin of a device instance
+type pluginState int
+
+const (
+	pluginStarting pluginState = iota
+	pluginRegistered
+	pluginFailed
+	pluginStopped
+)
+
+func (s pluginState) String() string {
+	switch s {
+	case pluginStarting:
+		return "starting"
+	case pluginRegistered:
+		return "registered"
+	case pluginFailed:
+		return "failed"
+	case pluginStopped:
+		return "stopped"
+	}
+	return "unknown"
+}
+
+// pluginSupervisor runs the device plugin of a device instance. When the
+// plugin fails to start or to register with kubelet it is retried with an
+// exponential backoff with jitter, without affecting the other plugins.
+type pluginSupervisor struct {
+	device  *DeviceInstance
+	changes chan<- struct{}
+
+	mu      sync.Mutex
+	state   pluginState
+	lastErr error
+
+	restart chan struct{}
+	update  chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// superviseDevice starts the supervisor of a device instance, changes is
+// signaled every time the state of the plugin changes
+func superviseDevice(device *DeviceInstance, changes chan<- struct{}) {
+	s := &pluginSupervisor{
+		device:  device,
+		changes: changes,
+		state:   pluginStarting,
+		restart: make(chan struct{}, 1),
+		update:  make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	device.supervisor = s
+	go s.run()
+}
+
+// unsuperviseDevices stops the device plugins of device instances and waits
+// for their supervisors to exit. Every supervisor is told to stop before
+// waiting for any of them, so the ones waiting for a start slot or in a
+// backoff exit at once instead of starting their plugin.
+func unsuperviseDevices(devices []*DeviceInstance) {
+	for _, device := range devices {
+		if device.supervisor != nil {
+			close(device.supervisor.stop)
+		}
+	}
+	for _, device := range devices {
+		if device.supervisor != nil {
+			<-device.supervisor.done
+			device.supervisor = nil
+		}
+	}
+}
+
+// status returns the current state of the plugin and the last error
+func (s *pluginSupervisor) status() (pluginState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.state, s.lastErr
+}
+
+func (s *pluginSupervisor) setState(state pluginState, err error) {
+	s.mu.Lock()
+	s.state = state
+	s.lastErr = err
+	s.mu.Unlock()
+
+	glog.V(1).Infof("Device %s is %s", s.device.deviceName, state)
+	select {
+	case s.changes <- struct{}{}:
+	default:
+	}
+}
+
+// Restart stops and starts the plugin again, e.g. after kubelet restarted,
+// skipping any pending backoff
+func (s *pluginSupervisor) Restart() {
+	select {
+	case s.restart <- struct{}{}:
+	default:
+	}
+}
+
+// Update sends the current device nodes of the device instance to its
+// running plugin. A plugin that is not running gets them when it starts.
+func (s *pluginSupervisor) Update() {
+	select {
+	case s.update <- struct{}{}:
+	default:
+	}
+}
+
+// acquireStartSlot waits for a start slot, it returns false if the
+// supervisor was stopped while waiting
+func (s *pluginSupervisor) acquireStartSlot() bool {
+	if startSlots == nil {
+		return true
+	}
+	select {
+	case startSlots <- struct{}{}:
+		return true
+	case <-s.stop:
+		return false
+	}
+}
+
+func (s *pluginSupervisor) releaseStartSlot() {
+	if startSlots != nil {
+		<-startSlots
+	}
+}
+
+// serve waits while the plugin is registered, sending it the device updates,
+// until it is stopped. It returns true if the plugin has to be restarted.
+func (s *pluginSupervisor) serve() bool {
+	for {
+		select {
+		case <-s.stop:
+			stopDevice(s.device)
+			s.setState(pluginStopped, nil)
+			return false
+		case <-s.restart:
+			glog.V(0).Infof("Restarting device %s", s.device.deviceName)
+			stopDevice(s.device)
+			return true
+		case <-s.update:
+			updateDevice(s.device)
+		}
+	}
+}
+
+func (s *pluginSupervisor) run() {
+	defer close(s.done)
+
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	backoff := initialRestartBackoff
+
+	for {
+		s.setState(pluginStarting, nil)
+		if !s.acquireStartSlot() {
+			s.setState(pluginStopped, nil)
+			return
+		}
+		err := startDevice(s.device)
+		s.releaseStartSlot()
+		if err == nil {
+			backoff = initialRestartBackoff
+			s.setState(pluginRegistered, nil)
+
+			if s.serve() {
+				continue
+			}
+			return
+		}
+
+		stopDevice(s.device)
+		s.setState(pluginFailed, err)
+
+		// Wait between half and all of the backoff so plugins that failed
+		// together do not retry together
+		delay := backoff/2 + time.Duration(random.Int63n(int64(backoff/2)+1))
+		glog.Errorf("Could not start device %s, retrying in %s: %s", s.device.deviceName, delay.Round(time.Millisecond), err)
+		if backoff *= 2; backoff > maxRestartBackoff {
+			backoff = maxRestartBackoff
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-s.stop:
+			timer.Stop()
+			s.setState(pluginStopped, nil)
+			return
+		case <-s.restart:
+			timer.Stop()
+			backoff = initialRestartBackoff
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,220 @@
+// Copyright (c) 2019, Arm Ltd
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// deviceNumber returns the kind ("char" or "block"), major and minor numbers
+// of a device file. Files that are not device nodes have an empty kind.
+func deviceNumber(deviceFile string) (string, uint64, uint64, error) {
+	fType, err := os.Stat(deviceFile)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	stat, ok := fType.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", 0, 0, fmt.Errorf("cannot stat %s", deviceFile)
+	}
+	switch fType.Mode() & (os.ModeDevice | os.ModeCharDevice) {
+	case os.ModeDevice | os.ModeCharDevice:
+		return "char", devMajor(uint64(stat.Rdev)), devMinor(uint64(stat.Rdev)), nil
+	case os.ModeDevice:
+		return "block", devMajor(uint64(stat.Rdev)), devMinor(uint64(stat.Rdev)), nil
+	}
+	return "", 0, 0, nil
+}
+
+// sysfsDeviceDir returns the /sys/dev directory describing a device file,
+// under -sys-root. Files that are not device nodes are their own sysfs
+// directory.
+func sysfsDeviceDir(deviceFile string) (string, error) {
+	kind, major, minor, err := deviceNumber(deviceFile)
+	if err != nil {
+		return "", err
+	}
+	if kind == "" {
+		return deviceFile, nil
+	}
+	return localPath(fmt.Sprintf("/sys/dev/%s/%d:%d", kind, major, minor)), nil
+}
+
+func devMajor(dev uint64) uint64 {
+	return ((dev >> 8) & 0xfff) | ((dev >> 32) &^ 0xfff)
+}
+
+func devMinor(dev uint64) uint64 {
+	return (dev & 0xff) | ((dev >> 12) &^ 0xff)
+}
+
+// sysfsDevicePath returns the directory under /sys/devices of the device
+// behind a device file
+func sysfsDevicePath(deviceFile string) (string, error) {
+	dir, err := sysfsDeviceDir(deviceFile)
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(dir)
+}
+
+// sysfsDevicesRoot returns the resolved path of /sys/devices under -sys-root,
+// ending with a slash, which the paths returned by sysfsDevicePath start with
+func sysfsDevicesRoot() string {
+	root := localPath("/sys/devices")
+	if resolved, err := filepath.EvalSymlinks(root); err == nil {
+		root = resolved
+	}
+	return root + "/"
+}
+
+// sysfsAttribute returns the value of a sysfs attribute of the device behind
+// a device file, looking up the parent devices when the device itself does
+// not have the attribute
+func sysfsAttribute(deviceFile string, attribute string) (string, error) {
+	dir, err := sysfsDevicePath(deviceFile)
+	if err != nil {
+		return "", err
+	}
+
+	root := sysfsDevicesRoot()
+	for strings.HasPrefix(dir, root) {
+		content, err := ioutil.ReadFile(filepath.Join(dir, attribute))
+		if err == nil {
+			return strings.TrimSpace(string(content)), nil
+		}
+		dir = filepath.Dir(dir)
+	}
+	return "", fmt.Errorf("no sysfs attribute %s for %s", attribute, deviceFile)
+}
+
+// sysfsDriver returns the kernel driver bound to the device behind a device
+// file or, for class devices such as ttyUSB0, to its closest parent device
+func sysfsDriver(deviceFile string) (string, error) {
+	dir, err := sysfsDevicePath(deviceFile)
+	if err != nil {
+		return "", err
+	}
+
+	root := sysfsDevicesRoot()
+	for strings.HasPrefix(dir, root) {
+		driver, err := os.Readlink(filepath.Join(dir, "driver"))
+		if err == nil {
+			return filepath.Base(driver), nil
+		}
+		dir = filepath.Dir(dir)
+	}
+	return "", fmt.Errorf("no driver bound to %s", deviceFile)
+}
+
+// sysfsSubsystem returns the subsystem of the device behind a device file,
+// e.g. tty, video4linux or block
+func sysfsSubsystem(deviceFile string) (string, error) {
+	dir, err := sysfsDevicePath(deviceFile)
+	if err != nil {
+		return "", err
+	}
+	subsystem, err := os.Readlink(filepath.Join(dir, "subsystem"))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Base(subsystem), nil
+}
+
+// SysfsMatch restricts a rule to the device files whose sysfs entries match.
+// Every field is a regular expression and all the fields set have to match.
+type SysfsMatch struct {
+	// Driver is matched against the driver bound to the device or to its
+	// closest parent, e.g. cp210x
+	Driver string `yaml:",omitempty"`
+	// Subsystem is matched against the subsystem of the device, e.g. tty
+	Subsystem string `yaml:",omitempty"`
+	// Attributes are matched against the attribute files of the device,
+	// looked up in the parent devices when the device does not have them,
+	// e.g. idVendor, idProduct, name or modalias. An empty pattern only
+	// requires the attribute to exist.
+	Attributes map[string]string `yaml:",omitempty"`
+
+	// The fields set, compiled when the configuration is loaded
+	driver     *regexp.Regexp
+	subsystem  *regexp.Regexp
+	attributes map[string]*regexp.Regexp
+}
+
+// compile checks that every field is a valid regular expression and
+// compiles it
+func (m *SysfsMatch) compile() error {
+	var err error
+	if m.Driver != "" {
+		if m.driver, err = regexp.Compile(m.Driver); err != nil {
+			return fmt.Errorf("invalid sysfs driver pattern: %s", err)
+		}
+	}
+	if m.Subsystem != "" {
+		if m.subsystem, err = regexp.Compile(m.Subsystem); err != nil {
+			return fmt.Errorf("invalid sysfs subsystem pattern: %s", err)
+		}
+	}
+	m.attributes = make(map[string]*regexp.Regexp)
+	for attribute, pattern := range m.Attributes {
+		if attribute == "" || filepath.IsAbs(attribute) || strings.Contains(attribute, "..") {
+			return fmt.Errorf("invalid sysfs attribute name %q", attribute)
+		}
+		if m.attributes[attribute], err = regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("invalid pattern for sysfs attribute %s: %s", attribute, err)
+		}
+	}
+	return nil
+}
+
+// sysfsCheck is a sysfs entry of a device file matched against a pattern
+type sysfsCheck struct {
+	name   string
+	re     *regexp.Regexp
+	lookup func(deviceFile string) (string, error)
+}
+
+// matches reports whether the sysfs entries of a device file match, and if
+// not the first one that does not
+func (m *SysfsMatch) matches(deviceFile string) (bool, string) {
+	if m == nil {
+		return true, ""
+	}
+
+	checks := []sysfsCheck{
+		{"driver", m.driver, sysfsDriver},
+		{"subsystem", m.subsystem, sysfsSubsystem},
+	}
+	attributes := make([]string, 0, len(m.attributes))
+	for attribute := range m.attributes {
+		attributes = append(attributes, attribute)
+	}
+	sort.Strings(attributes)
+	for _, attribute := range attributes {
+		attribute := attribute
+		checks = append(checks, sysfsCheck{"attribute " + attribute, m.attributes[attribute], func(deviceFile string) (string, error) {
+			return sysfsAttribute(deviceFile, attribute)
+		}})
+	}
+
+	for _, check := range checks {
+		if check.re == nil {
+			continue
+		}
+		value, err := check.lookup(deviceFile)
+		if err != nil {
+			return false, fmt.Sprintf("sysfs %s: %s", check.name, err)
+		}
+		if !check.re.MatchString(value) {
+			return false, fmt.Sprintf("sysfs %s %q does not match %s", check.name, value, check.re)
+		}
+	}
+	return true, ""
+}
@@ -0,0 +1,107 @@
+// Copyright (c) 2019, Arm Ltd
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const udevDataDir = "/run/udev/data"
+
+// udevProperties returns the properties udev recorded in its database for
+// the device behind a device file. Besides the E: properties the tags are
+// available as TAGS and CURRENT_TAGS (":tag1:tag2:") and the symlinks as
+// DEVLINKS, as udevadm info reports them.
+func udevProperties(deviceFile string) (map[string]string, error) {
+	kind, major, minor, err := deviceNumber(deviceFile)
+	if err != nil {
+		return nil, err
+	}
+	if kind == "" {
+		return nil, fmt.Errorf("%s is not a device node", deviceFile)
+	}
+
+	dataFile := fmt.Sprintf("%s/%c%d:%d", udevDataDir, kind[0], major, minor)
+	f, err := os.Open(dataFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return parseUdevData(f)
+}
+
+// parseUdevData parses the content of a udev database file
+func parseUdevData(r io.Reader) (map[string]string, error) {
+	properties := make(map[string]string)
+	var tags, currentTags, links []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if len(line) < 2 || line[1] != ':' {
+			continue
+		}
+		value := line[2:]
+		switch line[0] {
+		case 'E':
+			if i := strings.IndexByte(value, '='); i > 0 {
+				properties[value[:i]] = value[i+1:]
+			}
+		case 'G':
+			tags = append(tags, value)
+		case 'Q':
+			currentTags = append(currentTags, value)
+		case 'S':
+			links = append(links, "/dev/"+value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(tags) > 0 {
+		properties["TAGS"] = ":" + strings.Join(tags, ":") + ":"
+	}
+	if len(currentTags) > 0 {
+		properties["CURRENT_TAGS"] = ":" + strings.Join(currentTags, ":") + ":"
+	}
+	if len(links) > 0 {
+		properties["DEVLINKS"] = strings.Join(links, " ")
+	}
+	return properties, nil
+}
+
+// matchUdevProperties reports whether the udev properties of a device file
+// match every pattern of want, and if not the first property that does not
+func matchUdevProperties(deviceFile string, want map[string]*regexp.Regexp) (bool, string) {
+	if len(want) == 0 {
+		return true, ""
+	}
+
+	properties, err := udevProperties(deviceFile)
+	if err != nil {
+		return false, fmt.Sprintf("no udev properties: %s", err)
+	}
+
+	names := make([]string, 0, len(want))
+	for name := range want {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value, ok := properties[name]
+		if !ok {
+			return false, fmt.Sprintf("udev property %s is not set", name)
+		}
+		if !want[name].MatchString(value) {
+			return false, fmt.Sprintf("udev property %s %q does not match %s", name, value, want[name])
+		}
+	}
+	return true, ""
+}
@@ -0,0 +1,59 @@
+// Copyright (c) 2019, Arm Ltd
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseUdevData(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want map[string]string
+	}{
+		{
+			name: "empty",
+			data: "",
+			want: map[string]string{},
+		},
+		{
+			name: "properties",
+			data: "I:1234567\nE:ID_VENDOR_ID=10c4\nE:ID_MODEL=CP2102 USB to UART Bridge Controller\nE:ID_PATH=platform-3f980000.usb-usb-0:1.2:1.0\n",
+			want: map[string]string{
+				"ID_VENDOR_ID": "10c4",
+				"ID_MODEL":     "CP2102 USB to UART Bridge Controller",
+				"ID_PATH":      "platform-3f980000.usb-usb-0:1.2:1.0",
+			},
+		},
+		{
+			name: "tags and links",
+			data: "S:serial/by-id/usb-Silicon_Labs-if00-port0\nS:serial/by-path/platform-usb-0:1.2:1.0-port0\nG:systemd\nG:uaccess\nQ:systemd\nE:SUBSYSTEM=tty\n",
+			want: map[string]string{
+				"SUBSYSTEM":    "tty",
+				"TAGS":         ":systemd:uaccess:",
+				"CURRENT_TAGS": ":systemd:",
+				"DEVLINKS":     "/dev/serial/by-id/usb-Silicon_Labs-if00-port0 /dev/serial/by-path/platform-usb-0:1.2:1.0-port0",
+			},
+		},
+		{
+			name: "malformed lines",
+			data: "\nE\nE:NOVALUE\nE:=value\nX:ID_MODEL=unknown\nE:EMPTY=\n",
+			want: map[string]string{"EMPTY": ""},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseUdevData(strings.NewReader(test.data))
+			if err != nil {
+				t.Fatalf("parseUdevData: %s", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}